@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isOperator returns true if nick may use the admin commands.
+func isOperator(nick string) bool {
+	for _, op := range config.Operators {
+		if strings.EqualFold(op, nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// operatorOnly wraps a command so that only operators can use it.
+func operatorOnly(command commandFunc) commandFunc {
+	return func(nick string, args []string) []string {
+		if !isOperator(nick) {
+			return []string{fmt.Sprintf("%s: that command is for operators only.", nick)}
+		}
+		return command(nick, args)
+	}
+}
+
+// adminCommands implements the commands for operating the bot.
+type adminCommands struct {
+	settings *settingsStore
+	store    *checkinStore
+	budget   *apiBudget
+}
+
+// LogLevelCommand implements "!loglevel <debug|info|warn>".
+func (a *adminCommands) LogLevelCommand(nick string, args []string) []string {
+	if len(args) == 0 {
+		return []string{fmt.Sprintf("Log level is %s.", getLogLevel())}
+	}
+
+	level, err := parseLogLevel(args[0])
+	if err != nil {
+		return usage("loglevel <debug|info|warn>")
+	}
+
+	setLogLevel(level)
+	if err := a.settings.update(func(s *settings) { s.LogLevel = level.String() }); err != nil {
+		warnf("Unable to save settings: %s", err)
+	}
+	return []string{fmt.Sprintf("Log level is now %s.", level)}
+}
+
+// SetCommand implements "!set <flag> <true|false>".
+func (a *adminCommands) SetCommand(nick string, args []string) []string {
+	if len(args) != 2 {
+		return usage("set <flag> <true|false>")
+	}
+
+	name := strings.ToLower(args[0])
+	value, err := strconv.ParseBool(args[1])
+	if err != nil {
+		return usage("set <flag> <true|false>")
+	}
+	if !setFlag(name, value) {
+		return []string{fmt.Sprintf("Unknown flag %s. Flags: %s.", name, featureFlagNames())}
+	}
+
+	err = a.settings.update(func(s *settings) {
+		if s.Flags == nil {
+			s.Flags = make(map[string]bool)
+		}
+		s.Flags[name] = value
+	})
+	if err != nil {
+		warnf("Unable to save settings: %s", err)
+		return []string{fmt.Sprintf("%s is now %t, but saving it failed so it is lost on restart.", name, value)}
+	}
+	if !a.settings.saved() {
+		return []string{fmt.Sprintf("%s is now %t until restarting, set settings_file to keep it.", name, value)}
+	}
+	return []string{fmt.Sprintf("%s is now %t.", name, value)}
+}
+
+// GetCommand implements "!get <flag>".
+func (a *adminCommands) GetCommand(nick string, args []string) []string {
+	if len(args) != 1 {
+		return usage("get <flag>")
+	}
+
+	value, ok := getFlag(args[0])
+	if !ok {
+		return []string{fmt.Sprintf("Unknown flag %s. Flags: %s.", args[0], featureFlagNames())}
+	}
+	return []string{fmt.Sprintf("%s is %t.", strings.ToLower(args[0]), value)}
+}
+
+// updateUsers changes the tracked users and saves them in the settings.
+func (a *adminCommands) updateUsers(f func([]User) []User) {
+	usersMu.Lock()
+	config.Users = f(append([]User(nil), config.Users...))
+	users := append([]User(nil), config.Users...)
+	usersMu.Unlock()
+
+	if err := a.settings.update(func(s *settings) { s.Users = users }); err != nil {
+		warnf("Unable to save settings: %s", err)
+	}
+}
+
+// TrackCommand implements "!track <untappd user>".
+func (a *adminCommands) TrackCommand(nick string, args []string) []string {
+	if len(args) != 1 {
+		return usage("track <untappd user>")
+	}
+	if user, ok := trackedUser(args[0]); ok {
+		return []string{fmt.Sprintf("Already tracking %s.", user)}
+	}
+
+	name := args[0]
+	a.updateUsers(func(users []User) []User {
+		for _, user := range users {
+			if strings.EqualFold(user.Name, name) {
+				return users
+			}
+		}
+		return append(users, User{Name: name, Location: config.Location})
+	})
+	return []string{fmt.Sprintf("Now tracking %s, their checkins are fetched with the next poll.", name)}
+}
+
+// UntrackCommand implements "!untrack <untappd user>".
+func (a *adminCommands) UntrackCommand(nick string, args []string) []string {
+	if len(args) != 1 {
+		return usage("untrack <untappd user>")
+	}
+	name, ok := trackedUser(args[0])
+	if !ok {
+		return []string{fmt.Sprintf("Not tracking %s.", args[0])}
+	}
+
+	a.updateUsers(func(users []User) []User {
+		kept := make([]User, 0, len(users))
+		for _, user := range users {
+			if user.Name != name {
+				kept = append(kept, user)
+			}
+		}
+		return kept
+	})
+	return []string{fmt.Sprintf("No longer tracking %s.", name)}
+}
+
+// StatusCommand implements "!status".
+func (a *adminCommands) StatusCommand(nick string, args []string) []string {
+	checkins := 0
+	for _, count := range a.store.Counts() {
+		checkins += count
+	}
+	last := "no poll yet"
+	if t := lastPoll.lastPolled(); !t.IsZero() {
+		last = fmt.Sprintf("last poll %s ago", time.Since(t).Round(time.Second))
+	}
+	interval := time.Duration(pollInterval.get() * float64(time.Second))
+
+	remaining, untilReset := a.budget.remaining(time.Now())
+	quota := fmt.Sprintf("%d api calls left, resetting in %s", remaining, untilReset.Round(time.Minute))
+	if reported := a.budget.rateLimit(); !reported.seen.IsZero() {
+		quota += fmt.Sprintf(" (untappd says %d)", reported.remaining)
+	}
+
+	return []string{
+		fmt.Sprintf("Tracking %d users with %d cached checkins, %s, polling every %s.",
+			len(trackedUsers()), checkins, last, interval.Round(time.Second)),
+		quota + ".",
+	}
+}
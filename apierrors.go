@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"github.com/mdlayher/untappd"
+)
+
+// errorClass tells how a failed untappd api call should be handled.
+type errorClass int
+
+const (
+	// Network errors and 5xx responses, retried with backoff.
+	serverError errorClass = iota
+	// 429 responses, retried when the hourly limit resets.
+	rateLimitError
+	// Other 4xx responses, which will fail the same way if retried.
+	clientError
+)
+
+func (c errorClass) String() string {
+	switch c {
+	case rateLimitError:
+		return "rate limit"
+	case clientError:
+		return "client"
+	default:
+		return "server"
+	}
+}
+
+func classifyError(err error) errorClass {
+	var apiErr *untappd.Error
+	if !errors.As(err, &apiErr) {
+		return serverError
+	}
+
+	switch {
+	case apiErr.Code == http.StatusTooManyRequests:
+		return rateLimitError
+	case apiErr.Code >= 400 && apiErr.Code < 500:
+		return clientError
+	default:
+		return serverError
+	}
+}
+
+// Longest single wait before retrying a failed api call. The hourly
+// limit resets within this.
+const maxRetryWait = time.Hour
+
+// Shortest and longest backoff between retries of failed api calls.
+// Variables so that tests don't have to wait minutes.
+var (
+	retryMin = 60 * time.Second
+	retryMax = 30 * time.Minute
+)
+
+// newBackoff returns the backoff between retries of failed api calls.
+func newBackoff() *backoff.Backoff {
+	return &backoff.Backoff{
+		Min:    retryMin,
+		Max:    retryMax,
+		Factor: 2,
+		Jitter: true,
+	}
+}
+
+// retryDelay returns how long to wait before retrying a failed api call,
+// or false if the call should not be retried. It is never more than
+// maxRetryWait.
+func retryDelay(class errorClass, b *backoff.Backoff, budget *apiBudget) (time.Duration, bool) {
+	var d time.Duration
+	switch class {
+	case clientError:
+		return 0, false
+	case rateLimitError:
+		untilReset := budget.untilReset(time.Now())
+		if d = b.Duration(); d < untilReset {
+			d = untilReset
+		}
+	default:
+		d = b.Duration()
+	}
+	if d > maxRetryWait {
+		d = maxRetryWait
+	}
+	return d, true
+}
+
+// outageNotice posts once when untappd has failed threshold times in a row,
+// and again when it answers.
+type outageNotice struct {
+	threshold int
+	failures  int
+	notified  bool
+	cs        chan string
+}
+
+func newOutageNotice(threshold int, cs chan string) *outageNotice {
+	return &outageNotice{threshold: threshold, cs: cs}
+}
+
+func (o *outageNotice) failed(ctx context.Context) {
+	o.failures++
+	if !o.notified && o.failures >= o.threshold {
+		o.notified = true
+		warnw("Untappd api unreachable", "failures", o.failures)
+		sendContext(ctx, o.cs, "⚠️ Untappd API unreachable, will keep trying.")
+	}
+}
+
+func (o *outageNotice) succeeded(ctx context.Context) {
+	if o.notified {
+		infow("Untappd api recovered", "failures", o.failures)
+		sendContext(ctx, o.cs, "✅ Untappd API recovered.")
+	}
+	o.failures = 0
+	o.notified = false
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jpillora/backoff"
+)
+
+func TestNewBackoff(t *testing.T) {
+	b := newBackoff()
+	if b.Min != time.Minute || b.Max != 30*time.Minute || b.Factor != 2 || !b.Jitter {
+		t.Errorf("got %+v, want 1m to 30m doubling with jitter", b)
+	}
+	for i := 0; i < 20; i++ {
+		if d := b.Duration(); d > 30*time.Minute {
+			t.Fatalf("got %s on attempt %d, want at most 30m", d, i+1)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	if _, ok := retryDelay(clientError, newBackoff(), newApiBudget(ApiCallsPerHour)); ok {
+		t.Error("want client errors not retried")
+	}
+	if d, ok := retryDelay(serverError, newBackoff(), newApiBudget(ApiCallsPerHour)); !ok || d > 2*time.Minute {
+		t.Errorf("got %s, %v for the first server error, want about a minute", d, ok)
+	}
+
+	// Without a reported reset, a rate limit waits for the local window
+	budget := newApiBudget(ApiCallsPerHour)
+	budget.use(time.Now())
+	if d, _ := retryDelay(rateLimitError, newBackoff(), budget); d < 59*time.Minute {
+		t.Errorf("got %s after a rate limit, want to wait for the reset", d)
+	}
+
+	// However the backoff is set up, a single wait is clamped
+	b := &backoff.Backoff{Min: 2 * time.Hour, Max: 10 * time.Hour, Factor: 10}
+	for i := 0; i < 3; i++ {
+		if d, _ := retryDelay(serverError, b, budget); d != maxRetryWait {
+			t.Errorf("got %s, want %s at most", d, maxRetryWait)
+		}
+	}
+}
+
+func TestOutageNotice(t *testing.T) {
+	ctx := context.Background()
+	cs := make(chan string, 10)
+	o := newOutageNotice(3, cs)
+
+	// A short hiccup is only noticed in the log
+	o.failed(ctx)
+	o.failed(ctx)
+	o.succeeded(ctx)
+	if len(cs) != 0 {
+		t.Fatalf("posted %d notices for 2 failures, want none", len(cs))
+	}
+
+	for i := 0; i < 5; i++ {
+		o.failed(ctx)
+	}
+	if len(cs) != 1 {
+		t.Fatalf("posted %d notices for 5 failures, want one", len(cs))
+	}
+	if m := <-cs; m != "⚠️ Untappd API unreachable, will keep trying." {
+		t.Errorf("got %q, want the unreachable notice", m)
+	}
+	o.succeeded(ctx)
+	o.succeeded(ctx)
+	if len(cs) != 1 {
+		t.Fatalf("posted %d notices on recovering, want one", len(cs))
+	}
+	if m := <-cs; m != "✅ Untappd API recovered." {
+		t.Errorf("got %q, want the recovered notice", m)
+	}
+
+	// The count starts over after recovering
+	o.failed(ctx)
+	o.failed(ctx)
+	if len(cs) != 0 {
+		t.Errorf("posted %d notices for 2 new failures, want none", len(cs))
+	}
+}
+
+func TestRetryDelayReportedReset(t *testing.T) {
+	// The local window has just started, but untappd's quota resets in
+	// five minutes
+	budget := newApiBudget(ApiCallsPerHour)
+	budget.use(time.Now())
+	budget.reported = rateLimitState{reset: time.Now().Add(5 * time.Minute), seen: time.Now()}
+	if d, _ := retryDelay(rateLimitError, newBackoff(), budget); d < 4*time.Minute || d > 5*time.Minute {
+		t.Errorf("got %s, want to wait for untappd's reset in 5m", d)
+	}
+
+	// A reset that has passed says nothing about the current quota
+	budget.reported = rateLimitState{reset: time.Now().Add(-time.Minute), seen: time.Now().Add(-time.Hour)}
+	if d, _ := retryDelay(rateLimitError, newBackoff(), budget); d < 59*time.Minute {
+		t.Errorf("got %s, want to wait for the local window", d)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/mdlayher/untappd"
+)
+
+// Number of beers kept by beerCache.
+const beerCacheSize int = 100
+
+// beerCache keeps the most recently used beers fetched from untappd for
+// ttl, so that looking up the same beer again doesn't use an api call.
+type beerCache struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	size  int
+	order *list.List // most recently used first
+	beers map[int]*list.Element
+}
+
+type cachedBeer struct {
+	beer    *untappd.Beer
+	fetched time.Time
+}
+
+func newBeerCache(size int, ttl time.Duration) *beerCache {
+	return &beerCache{
+		ttl:   ttl,
+		size:  size,
+		order: list.New(),
+		beers: make(map[int]*list.Element),
+	}
+}
+
+// get returns the beer if it was cached less than ttl before now.
+func (c *beerCache) get(id int, now time.Time) (*untappd.Beer, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.beers[id]
+	if !ok {
+		return nil, false
+	}
+	cached := e.Value.(*cachedBeer)
+	if now.Sub(cached.fetched) >= c.ttl {
+		c.order.Remove(e)
+		delete(c.beers, id)
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return cached.beer, true
+}
+
+// put caches the beer, dropping the least recently used one if full.
+func (c *beerCache) put(beer *untappd.Beer, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.beers[beer.ID]; ok {
+		e.Value = &cachedBeer{beer, now}
+		c.order.MoveToFront(e)
+		return
+	}
+	c.beers[beer.ID] = c.order.PushFront(&cachedBeer{beer, now})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.beers, oldest.Value.(*cachedBeer).beer.ID)
+	}
+}
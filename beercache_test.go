@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mdlayher/untappd"
+)
+
+func TestBeerCache(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := newBeerCache(2, time.Hour)
+
+	if _, ok := c.get(1, now); ok {
+		t.Error("got a beer from an empty cache")
+	}
+	c.put(&untappd.Beer{ID: 1, Name: "Pliny"}, now)
+	if beer, ok := c.get(1, now.Add(59*time.Minute)); !ok || beer.Name != "Pliny" {
+		t.Errorf("got %v, %v, want Pliny cached", beer, ok)
+	}
+	if _, ok := c.get(1, now.Add(time.Hour)); ok {
+		t.Error("got a beer cached an hour ago, want it expired")
+	}
+	if _, ok := c.get(1, now); ok {
+		t.Error("got an expired beer again, want it dropped")
+	}
+
+	// The least recently used beer is dropped when full
+	c.put(&untappd.Beer{ID: 1}, now)
+	c.put(&untappd.Beer{ID: 2}, now)
+	c.get(1, now)
+	c.put(&untappd.Beer{ID: 3}, now)
+	if _, ok := c.get(2, now); ok {
+		t.Error("got beer 2, want it dropped for beer 3")
+	}
+	if _, ok := c.get(1, now); !ok {
+		t.Error("beer 1 was used last, want it kept")
+	}
+}
+
+func TestGetBeerCached(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config = Config{BeerTTL: time.Hour}
+
+	// No client and no api calls left, so only the cache can answer
+	l := newLookupCommands(nil, newApiBudget(0))
+	l.beers.put(&untappd.Beer{ID: 1, Name: "Pliny"}, time.Now())
+	if beer, err := l.getBeer(1); err != nil || beer.Name != "Pliny" {
+		t.Errorf("got %v, %v, want Pliny from the cache", beer, err)
+	}
+	if _, err := l.getBeer(2); err != errLookupLimited {
+		t.Errorf("got %v for an uncached beer, want it rate limited", err)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Untappd allows (only!) 100 api calls per hour
+const ApiCallsPerHour int = 100
+
+// Number of api calls per hour the poll loop leaves for other uses, like
+// user commands.
+const budgetReserve int = 10
+
+// apiBudget counts the untappd api calls made in the current hour so that
+// everything talking to untappd can share the same hourly limit.
+type apiBudget struct {
+	mu       sync.Mutex
+	limit    int
+	calls    int
+	window   time.Time
+	reported rateLimitState
+}
+
+func newApiBudget(limit int) *apiBudget {
+	return &apiBudget{limit: limit}
+}
+
+// reset starts a new window if the current one is more than an hour old.
+// Must be called with the lock held.
+func (b *apiBudget) reset(now time.Time) {
+	if now.Sub(b.window) >= time.Hour {
+		b.window = now
+		b.calls = 0
+	}
+}
+
+// use records a single api call.
+func (b *apiBudget) use(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.reset(now)
+	b.calls++
+	apiCalls.inc()
+}
+
+// remaining returns the number of calls left in the current window and
+// how long until the window resets.
+func (b *apiBudget) remaining(now time.Time) (int, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.reset(now)
+	left := b.limit - b.calls
+	if left < 0 {
+		left = 0
+	}
+	return left, b.window.Add(time.Hour).Sub(now)
+}
+
+// untilReset returns how long until the quota resets: when untappd said
+// it would, if it has said so for the current quota, or else when the
+// local window does.
+func (b *apiBudget) untilReset(now time.Time) time.Duration {
+	if reported := b.rateLimit(); !reported.seen.IsZero() && now.Before(reported.reset) {
+		return reported.reset.Sub(now)
+	}
+	_, untilReset := b.remaining(now)
+	return untilReset
+}
+
+// report records the quota untappd reported in the headers of a response.
+func (b *apiBudget) report(resp *http.Response, now time.Time) {
+	state, ok := parseRateLimit(resp, now)
+	if !ok {
+		return
+	}
+	debugw("Untappd rate limit", "remaining", state.remaining, "reset", state.reset)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reported = state
+}
+
+// rateLimit returns the quota untappd reported last.
+func (b *apiBudget) rateLimit() rateLimitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.reported
+}
+
+// rateLimitState is the api quota as reported by untappd, which also
+// counts calls made before a restart or by other clients using the same
+// api key.
+type rateLimitState struct {
+	remaining int
+	reset     time.Time
+	seen      time.Time
+}
+
+// parseRateLimit reads the rate limit headers of an untappd response.
+func parseRateLimit(resp *http.Response, now time.Time) (rateLimitState, bool) {
+	if resp == nil {
+		return rateLimitState{}, false
+	}
+	remaining, err := strconv.Atoi(resp.Header.Get("X-Ratelimit-Remaining"))
+	if err != nil {
+		return rateLimitState{}, false
+	}
+
+	// Untappd doesn't always say when the quota resets, so assume the
+	// worst: a full hour from now
+	state := rateLimitState{remaining: remaining, reset: now.Add(time.Hour), seen: now}
+	if reset, err := strconv.ParseInt(resp.Header.Get("X-Ratelimit-Reset"), 10, 64); err == nil {
+		state.reset = time.Unix(reset, 0)
+	}
+	return state, true
+}
+
+// safeSleep returns how long to wait before the next poll cycle of
+// numUsers users so that the reported quota lasts until it resets. It is
+// 0 if nothing has been reported, or the quota has reset since.
+func (s rateLimitState) safeSleep(numUsers int, now time.Time) time.Duration {
+	if s.seen.IsZero() || !now.Before(s.reset) {
+		return 0
+	}
+	if numUsers < 1 {
+		numUsers = 1
+	}
+
+	untilReset := s.reset.Sub(now)
+	cycles := (s.remaining - budgetReserve) / numUsers
+	if cycles <= 0 {
+		return untilReset
+	}
+	return untilReset / time.Duration(cycles)
+}
+
+// tokenBucket allows bursts of up to capacity tokens, refilled at capacity
+// tokens per period.
+type tokenBucket struct {
+	mu       sync.Mutex
+	capacity float64
+	tokens   float64
+	rate     float64 // tokens per second
+	last     time.Time
+}
+
+func newTokenBucket(capacity int, period time.Duration) *tokenBucket {
+	return &tokenBucket{
+		capacity: float64(capacity),
+		tokens:   float64(capacity),
+		rate:     float64(capacity) / period.Seconds(),
+	}
+}
+
+// take removes n tokens if there are that many.
+func (t *tokenBucket) take(n int, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.last.IsZero() {
+		t.tokens = math.Min(t.capacity, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+	}
+	t.last = now
+
+	if t.tokens < float64(n) {
+		return false
+	}
+	t.tokens -= float64(n)
+	return true
+}
+
+// pollScheduler adapts the poll interval to how active the users are:
+// it polls more often while checkins keep coming and backs off when it
+// is quiet, but never faster than the api budget allows.
+type pollScheduler struct {
+	min      time.Duration
+	max      time.Duration
+	interval time.Duration
+}
+
+func newPollScheduler(numUsers int) *pollScheduler {
+	base := time.Duration(calculatePollInterval(numUsers)) * time.Minute
+	return &pollScheduler{
+		min:      time.Minute,
+		max:      time.Duration(math.Max(float64(base), float64(30*time.Minute))),
+		interval: base,
+	}
+}
+
+// next returns how long to sleep before the next poll cycle, given the
+// number of new checkins seen in the last cycle and the state of the
+// budget. Each cycle costs one api call per user.
+func (p *pollScheduler) next(newCheckins int, numUsers int, remaining int, untilReset time.Duration) time.Duration {
+	if newCheckins > 0 {
+		p.interval = p.interval / 2
+	} else {
+		p.interval = p.interval * 3 / 2
+	}
+	if p.interval < p.min {
+		p.interval = p.min
+	}
+	if p.interval > p.max {
+		p.interval = p.max
+	}
+
+	// Spread the remaining calls over the rest of the window, leaving the
+	// reserve the poll loop won't touch
+	if numUsers < 1 {
+		numUsers = 1
+	}
+	cycles := (remaining - budgetReserve) / numUsers
+	if cycles <= 0 {
+		return untilReset
+	}
+	if budgeted := untilReset / time.Duration(cycles); budgeted > p.interval {
+		return budgeted
+	}
+	return p.interval
+}
+
+// syncUsers returns the poll order with the users no longer tracked
+// removed, and newly tracked users added last.
+func syncUsers(order []string, users []User) []string {
+	tracked := make(map[string]bool, len(users))
+	for _, user := range users {
+		tracked[user.Name] = true
+	}
+
+	synced := make([]string, 0, len(users))
+	for _, name := range order {
+		if tracked[name] {
+			synced = append(synced, name)
+			delete(tracked, name)
+		}
+	}
+	for _, user := range users {
+		if tracked[user.Name] {
+			synced = append(synced, user.Name)
+		}
+	}
+	return synced
+}
+
+// containsString returns true if name is in the list.
+func containsString(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// rotateUsers returns the poll order for the next cycle when only the first
+// polled users were polled in this one: the skipped users go first.
+func rotateUsers(order []string, polled int) []string {
+	rotated := make([]string, 0, len(order))
+	rotated = append(rotated, order[polled:]...)
+	return append(rotated, order[:polled]...)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPollSchedulerAdapts(t *testing.T) {
+	p := newPollScheduler(4)
+	start := p.interval
+
+	// Checkins keep coming: poll more often, down to once a minute
+	var sleep time.Duration
+	for i := 0; i < 10; i++ {
+		sleep = p.next(3, 4, ApiCallsPerHour, time.Hour)
+	}
+	if p.interval != time.Minute {
+		t.Errorf("got an interval of %s while active, want 1m", p.interval)
+	}
+	// But not more often than 100 calls an hour, less the reserve, allow
+	// for 4 users
+	if want := time.Hour / 22; sleep != want {
+		t.Errorf("got %s while active, want %s", sleep, want)
+	}
+
+	// Quiet again: back off, up to 30 minutes
+	for i := 0; i < 20; i++ {
+		sleep = p.next(0, 4, ApiCallsPerHour, time.Hour)
+	}
+	if sleep != 30*time.Minute || sleep <= start {
+		t.Errorf("got %s while quiet, want 30m", sleep)
+	}
+}
+
+func TestPollSchedulerStaysWithinBudget(t *testing.T) {
+	p := newPollScheduler(4)
+	// Very active, but only enough calls beyond the reserve left for two
+	// more cycles
+	for i := 0; i < 10; i++ {
+		p.next(5, 4, ApiCallsPerHour, time.Hour)
+	}
+	if sleep := p.next(5, 4, budgetReserve+8, 40*time.Minute); sleep != 20*time.Minute {
+		t.Errorf("got %s with 8 calls beyond the reserve for 4 users, want 20m", sleep)
+	}
+	if sleep := p.next(5, 4, budgetReserve+3, 40*time.Minute); sleep != 40*time.Minute {
+		t.Errorf("got %s with too few calls beyond the reserve for a cycle, want to wait for the reset", sleep)
+	}
+	// The reserve isn't spent on polling, however many calls it has
+	if sleep := p.next(5, 4, budgetReserve, 40*time.Minute); sleep != 40*time.Minute {
+		t.Errorf("got %s with only the reserve left, want to wait for the reset", sleep)
+	}
+}
+
+func TestOversizedUserList(t *testing.T) {
+	users := make([]string, 200)
+	for i := range users {
+		users[i] = fmt.Sprintf("user%03d", i)
+	}
+
+	// Polling everyone each cycle would take two hours of calls
+	if interval := calculatePollInterval(len(users)); interval < 120 {
+		t.Errorf("got an interval of %d minutes, want at least 120", interval)
+	}
+
+	// Each cycle polls as many as the budget allows, the rest go first in
+	// the next one
+	seen := make(map[string]int)
+	order := users
+	perCycle := ApiCallsPerHour - budgetReserve
+	for cycle := 0; cycle < 3; cycle++ {
+		for _, user := range order[:min(perCycle, len(order))] {
+			seen[user]++
+		}
+		order = rotateUsers(order, min(perCycle, len(order)))
+	}
+	if len(seen) != len(users) {
+		t.Errorf("polled %d users in three cycles, want all %d", len(seen), len(users))
+	}
+	for user, n := range seen {
+		if n > 2 {
+			t.Errorf("polled %s %d times in three cycles, want at most twice", user, n)
+		}
+	}
+}
+
+func TestGetAllCheckinsWaitsForBudget(t *testing.T) {
+	source := newFakeSource(testCheckins("alice", 1, 120)...)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// One call left: the first page is fetched, then it waits for the reset
+	checkins, _ := getAllCheckins(ctx, "alice", 0, CheckinApiLimit, source, newApiBudget(1))
+	if len(checkins) != checkinsPageSize || source.callCount() != 1 {
+		t.Errorf("got %d checkins in %d calls, want one page before waiting", len(checkins), source.callCount())
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	header := func(kv ...string) *http.Response {
+		h := make(http.Header)
+		for i := 0; i < len(kv); i += 2 {
+			h.Set(kv[i], kv[i+1])
+		}
+		return &http.Response{Header: h}
+	}
+
+	if _, ok := parseRateLimit(nil, now); ok {
+		t.Error("got a rate limit without a response")
+	}
+	if _, ok := parseRateLimit(header(), now); ok {
+		t.Error("got a rate limit without the headers")
+	}
+	if _, ok := parseRateLimit(header("X-Ratelimit-Remaining", "lots"), now); ok {
+		t.Error("got a rate limit from a malformed header")
+	}
+
+	state, ok := parseRateLimit(header("X-Ratelimit-Remaining", "42"), now)
+	if !ok || state.remaining != 42 || !state.reset.Equal(now.Add(time.Hour)) {
+		t.Errorf("got %+v, %v, want 42 left resetting in an hour", state, ok)
+	}
+	reset := now.Add(10 * time.Minute)
+	state, _ = parseRateLimit(header("X-Ratelimit-Remaining", "42",
+		"X-Ratelimit-Reset", strconv.FormatInt(reset.Unix(), 10)), now)
+	if !state.reset.Equal(reset) {
+		t.Errorf("got a reset at %s, want %s", state.reset, reset)
+	}
+}
+
+func TestRateLimitSafeSleep(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	state := rateLimitState{remaining: 50, reset: now.Add(40 * time.Minute), seen: now}
+
+	if sleep := (rateLimitState{}).safeSleep(4, now); sleep != 0 {
+		t.Errorf("got %s without a reported limit, want 0", sleep)
+	}
+	// 40 calls beyond the reserve last 10 cycles of 4 users
+	if sleep := state.safeSleep(4, now); sleep != 4*time.Minute {
+		t.Errorf("got %s, want 4m", sleep)
+	}
+	if sleep := state.safeSleep(100, now); sleep != 40*time.Minute {
+		t.Errorf("got %s without enough calls for a cycle, want to wait for the reset", sleep)
+	}
+	if sleep := state.safeSleep(4, now.Add(time.Hour)); sleep != 0 {
+		t.Errorf("got %s after the reset, want 0", sleep)
+	}
+}
+
+func TestGetCheckinsReportsRateLimit(t *testing.T) {
+	source := newFakeSource(testCheckins("alice", 1, 30)...)
+	source.header = http.Header{"X-Ratelimit-Remaining": {"17"}}
+	budget := newApiBudget(ApiCallsPerHour)
+
+	getCheckins(context.Background(), "alice", source, budget, newOutageNotice(3, make(chan string, 1)))
+	if got := budget.rateLimit().remaining; got != 17 {
+		t.Errorf("got %d calls left after polling, want 17", got)
+	}
+
+	source.header.Set("X-Ratelimit-Remaining", "9")
+	getAllCheckins(context.Background(), "alice", 0, CheckinApiLimit, source, budget)
+	if got := budget.rateLimit().remaining; got != 9 {
+		t.Errorf("got %d calls left after fetching the history, want 9", got)
+	}
+}
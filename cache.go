@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/mdlayher/untappd"
+)
+
+// savedCache is the file written by saveCache.
+type savedCache struct {
+	Checkins map[string][]*untappd.Checkin `json:"checkins"`
+	// Users of whom only the latest checkins are cached, because untappd
+	// wouldn't return their whole history.
+	Capped map[string]bool `json:"capped,omitempty"`
+}
+
+// saveCache writes the cached checkins of every user to fileName, so they
+// don't have to be fetched again after a restart.
+func saveCache(userCheckins map[string][]*untappd.Checkin, capped map[string]bool, fileName string) error {
+	saved := savedCache{Checkins: userCheckins, Capped: make(map[string]bool)}
+	for user := range userCheckins {
+		if capped[user] {
+			saved.Capped[user] = true
+		}
+	}
+	body, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that a crash never leaves a
+	// half written cache behind
+	tmp := fileName + ".tmp"
+	if err := ioutil.WriteFile(tmp, body, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fileName)
+}
+
+// loadCache reads the checkins and capped users saved by saveCache. The
+// capped users are nil for a file written before they were saved, which
+// only has the checkins.
+func loadCache(fileName string) (map[string][]*untappd.Checkin, map[string]bool, error) {
+	body, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var saved savedCache
+	if err := json.Unmarshal(body, &saved); err == nil && saved.Checkins != nil {
+		if saved.Capped == nil {
+			saved.Capped = make(map[string]bool)
+		}
+		return saved.Checkins, saved.Capped, nil
+	}
+
+	userCheckins := make(map[string][]*untappd.Checkin)
+	if err := json.Unmarshal(body, &userCheckins); err != nil {
+		return nil, nil, err
+	}
+	return userCheckins, nil, nil
+}
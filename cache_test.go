@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/untappd"
+)
+
+func TestCacheRoundTrip(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "cache.json")
+	userCheckins := map[string][]*untappd.Checkin{
+		"alice": testCheckins("alice", 1, 3),
+		"bob":   testCheckins("bob", 10, 2),
+	}
+	userCheckins["alice"][0].Venue = &untappd.Venue{ID: 7, Name: "The Local"}
+	capped := map[string]bool{"bob": true, "carol": true}
+
+	if err := saveCache(userCheckins, capped, fileName); err != nil {
+		t.Fatal(err)
+	}
+	loaded, loadedCapped, err := loadCache(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(loaded) != 2 || len(loaded["alice"]) != 3 || len(loaded["bob"]) != 2 {
+		t.Fatalf("got %v, want the saved checkins", loaded)
+	}
+	got, want := loaded["alice"][0], userCheckins["alice"][0]
+	if got.ID != want.ID || !got.Created.Equal(want.Created) || got.UserRating != want.UserRating ||
+		got.Beer.Name != want.Beer.Name || got.Venue == nil || got.Venue.Name != "The Local" {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	// Only users with a cache
+	if len(loadedCapped) != 1 || !loadedCapped["bob"] {
+		t.Errorf("got capped %v, want only bob", loadedCapped)
+	}
+}
+
+func TestLoadOldCache(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "cache.json")
+	body, _ := json.Marshal(map[string][]*untappd.Checkin{"alice": testCheckins("alice", 1, 3)})
+	if err := ioutil.WriteFile(fileName, body, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, capped, err := loadCache(fileName)
+	if err != nil || len(loaded["alice"]) != 3 || capped != nil {
+		t.Errorf("got %d checkins, capped %v, %v, want 3 checkins and unknown capped users",
+			len(loaded["alice"]), capped, err)
+	}
+}
+
+func TestLoadBrokenCache(t *testing.T) {
+	dir := t.TempDir()
+	if _, _, err := loadCache(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("got no error for a missing file")
+	}
+	fileName := filepath.Join(dir, "cache.json")
+	ioutil.WriteFile(fileName, []byte(`{"checkins": {"alice": [`), 0644)
+	if _, _, err := loadCache(fileName); err == nil {
+		t.Error("got no error for a corrupt file")
+	}
+}
+
+func TestUntappdLoopKeepsCappedAcrossRestarts(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	fileName := filepath.Join(t.TempDir(), "cache.json")
+	config = Config{
+		Users:             []User{{Name: "alice"}},
+		Location:          time.UTC,
+		InitialFetchCount: 5,
+		StartupStats:      "each",
+		UnreachableAfter:  5,
+		CacheFile:         fileName,
+		ShowMilestones:    true,
+		Milestones:        []int{6},
+	}
+
+	// Only the latest 5 of alice's checkins were fetched before the restart
+	saveCache(map[string][]*untappd.Checkin{"alice": testCheckins("alice", 11, 5)},
+		map[string]bool{"alice": true}, fileName)
+	source := newFakeSource(testCheckins("alice", 1, 15)...)
+	source.pending["alice"] = testCheckins("alice", 16, 1)
+
+	messages := runPollCycle(t, source, newCheckinStore(), newApiBudget(ApiCallsPerHour), nil)
+	if len(messages) == 0 || !strings.Contains(messages[0], "Only the latest 5 checkins") {
+		t.Errorf("got %q, want the stats marked as partial", messages)
+	}
+	for _, m := range messages {
+		if strings.Contains(m, "just hit") {
+			t.Errorf("got %q, want no milestone from a partial cache", m)
+		}
+	}
+	if _, capped, _ := loadCache(fileName); !capped["alice"] {
+		t.Error("want alice still capped in the saved cache")
+	}
+}
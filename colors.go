@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// mIRC formatting codes.
+const (
+	ircBold  = "\x02"
+	ircColor = "\x03"
+	ircReset = "\x0f"
+)
+
+// mIRC color numbers.
+const (
+	colorGreen  = 3
+	colorRed    = 4
+	colorYellow = 8
+	colorTeal   = 10
+)
+
+// bold makes s bold, if colors are enabled.
+func bold(s string) string {
+	if !enabled("colors") {
+		return s
+	}
+	return ircBold + s + ircBold
+}
+
+// colored gives s the color, if colors are enabled.
+func colored(color int, s string) string {
+	if !enabled("colors") {
+		return s
+	}
+	return fmt.Sprintf("%s%02d%s%s", ircColor, color, s, ircColor)
+}
+
+// ratingColor returns the color of a rating: green for good, yellow for
+// average and red for bad.
+func ratingColor(rating float64) int {
+	switch {
+	case rating >= 3.75:
+		return colorGreen
+	case rating >= 2.75:
+		return colorYellow
+	default:
+		return colorRed
+	}
+}
+
+var formattingCodes = regexp.MustCompile("\x03[0-9]{0,2}(,[0-9]{1,2})?|[\x02\x0f\x16\x1d\x1f]")
+
+// stripFormatting removes mIRC formatting codes from s.
+func stripFormatting(s string) string {
+	return formattingCodes.ReplaceAllString(s, "")
+}
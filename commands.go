@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mdlayher/untappd"
+	"github.com/nickvanw/ircx/v2"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+// commandFunc implements a single bot command. nick is the irc user who
+// issued the command and args are the words following the command name.
+// The returned lines are sent back to the channel the command was given in.
+type commandFunc func(nick string, args []string) []string
+
+// parseCommand splits a message into a command name and its arguments.
+// Commands are either prefixed with config.CommandPrefix ("!stats alice")
+// or address the bot by nick ("untappdbot: stats alice").
+func parseCommand(text string, botNick string) (string, []string, bool) {
+	text = strings.TrimSpace(text)
+	switch {
+	case strings.HasPrefix(text, config.CommandPrefix):
+		text = text[len(config.CommandPrefix):]
+	case len(text) > len(botNick) && strings.EqualFold(text[:len(botNick)], botNick) &&
+		strings.ContainsRune(":, ", rune(text[len(botNick)])):
+		text = strings.TrimLeft(text[len(botNick):], ":, ")
+	default:
+		return "", nil, false
+	}
+
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return "", nil, false
+	}
+	return strings.ToLower(fields[0]), fields[1:], true
+}
+
+// usage formats the usage reply of a command.
+func usage(command string) []string {
+	return []string{fmt.Sprintf("Usage: %s%s", config.CommandPrefix, command)}
+}
+
+// CommandHandler returns a PRIVMSG handler which dispatches commands in
+// the channels to the matching commandFunc. Each command runs in its own
+// goroutine, so that slow ones like !fullstats and !beer, which make http
+// requests, don't hold up the irc handler loop which also answers PINGs.
+func CommandHandler(commands map[string]commandFunc, replies chan targetedMessage) func(s ircx.Sender, m *irc.Message) {
+	return func(s ircx.Sender, m *irc.Message) {
+		if m.Prefix == nil || !isChannel(m.Param(0)) {
+			return
+		}
+
+		name, args, ok := parseCommand(m.Trailing(), getNick())
+		if !ok {
+			return
+		}
+
+		command, ok := commands[name]
+		if !ok {
+			return
+		}
+
+		go func(nick string, channel string) {
+			for _, line := range command(nick, args) {
+				replies <- targetedMessage{target: channel, text: line}
+			}
+		}(m.Prefix.Name, m.Param(0))
+	}
+}
+
+// Minimum number of checkins a user needs for !favbrewery.
+const favBreweryMinCheckins int = 3
+
+// Number of beers listed by !trending.
+const trendingMaxBeers int = 3
+
+// A beer is recommended if at least recommendMinRaters users have rated it
+// recommendMinRating or better on average.
+const recommendMinRating float64 = 3.75
+const recommendMinRaters int = 2
+const recommendMaxBeers int = 3
+
+// !next suggests styles a user has rated at least nextMinRated times, and
+// not had for nextRecent.
+const nextMinRated int = 2
+const nextRecent time.Duration = 14 * 24 * time.Hour
+
+// Number of styles listed by !stylebreakdown.
+const styleBreakdownMaxStyles int = 5
+
+// Number of styles listed by !styles.
+const userStylesMaxStyles int = 3
+
+// Length of the comment preview shown by !wordy.
+const wordyPreviewLength int = 100
+
+// Number of users listed by !leaderboard.
+const leaderboardMaxUsers int = 10
+
+// Default and maximum number of checkins posted by !recent.
+const recentDefaultCheckins int = 3
+const recentMaxCheckins int = 10
+
+// Maximum number of checkins posted by !throwback.
+const throwbackMaxLines int = 5
+
+// Number of lines of !fullstats sent privately when there is no paste
+// service to upload the full table to.
+const fullStatsMaxLines int = 10
+
+// cacheCommands implements the commands which are answered from the
+// checkin cache, without calling the untappd api.
+type cacheCommands struct {
+	store   *checkinStore
+	private chan targetedMessage
+}
+
+// userCheckins looks up the cached checkins of a tracked user, returning
+// the configured spelling of the name.
+func (q *cacheCommands) userCheckins(name string) (string, []*untappd.Checkin, bool) {
+	user, ok := trackedUser(name)
+	if !ok {
+		return name, nil, false
+	}
+	checkins, _ := q.store.Get(user)
+	return user, checkins, true
+}
+
+// fullStatsTable formats the statistics of every user as an aligned text
+// table, one line per user.
+func fullStatsTable(userCheckins map[string][]*untappd.Checkin) string {
+	users := make([]string, 0, len(userCheckins))
+	for user := range userCheckins {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "User\tCheckins\tRated\tMean\tStdev\tFavorite style")
+	for _, user := range users {
+		count, mean, stdev := getUserStats(userCheckins[user])
+		fmt.Fprintf(w, "%s\t%d\t%d\t%0.2f\t%0.2f\t%s\n",
+			user, count, countRated(userCheckins[user]), mean, stdev, favoriteStyle(userCheckins[user]))
+	}
+	w.Flush()
+
+	return buf.String()
+}
+
+// FullStatsCommand implements "!fullstats". The table is uploaded to the
+// paste service if one is configured, otherwise a truncated version is
+// sent privately to the caller.
+func (q *cacheCommands) FullStatsCommand(nick string, args []string) []string {
+	table := fullStatsTable(q.store.Snapshot())
+
+	if config.PasteURL != "" {
+		link, err := uploadPaste(table)
+		if err == nil {
+			return []string{fmt.Sprintf("Full stats: %s", link)}
+		}
+		warnf("Unable to upload stats: %s", err)
+	}
+
+	lines := strings.Split(strings.TrimRight(table, "\n"), "\n")
+	if len(lines) > fullStatsMaxLines {
+		lines = append(lines[:fullStatsMaxLines], "...")
+	}
+	for _, line := range lines {
+		q.private <- targetedMessage{target: nick, text: line}
+	}
+
+	return []string{fmt.Sprintf("%s: sent you the stats privately.", nick)}
+}
+
+// StatsCommand implements "!stats <user>".
+func (q *cacheCommands) StatsCommand(nick string, args []string) []string {
+	if len(args) == 0 {
+		return usage("stats <user>")
+	}
+
+	user, checkins, ok := q.userCheckins(args[0])
+	if !ok {
+		return []string{fmt.Sprintf("Not tracking %s.", user)}
+	}
+	return []string{formatUserStats(user, checkins)}
+}
+
+// throwbackLines formats the cached checkins made on the same date one year
+// before now, in config.Location.
+func throwbackLines(userCheckins map[string][]*untappd.Checkin, now time.Time) []string {
+	now = now.In(config.Location)
+	year, month, day := now.AddDate(-1, 0, 0).Date()
+
+	var throwbacks []*untappd.Checkin
+	for _, checkins := range userCheckins {
+		for _, c := range checkins {
+			y, m, d := c.Created.In(config.Location).Date()
+			if y == year && m == month && d == day {
+				throwbacks = append(throwbacks, c)
+			}
+		}
+	}
+	sort.Sort(byCheckinTime(throwbacks))
+
+	lines := make([]string, 0, len(throwbacks))
+	for _, c := range throwbacks[:min(throwbackMaxLines, len(throwbacks))] {
+		lines = append(lines, fmt.Sprintf("One year ago today, %s had %s (%s).",
+			c.User.UserName, c.Beer.Name, c.Brewery.Name))
+	}
+	return lines
+}
+
+// buildDailySummary formats a recap of the cached checkins made on the
+// same date as now, in config.Location: the number of checkins, the
+// highest rated beer and the most active user.
+func buildDailySummary(userCheckins map[string][]*untappd.Checkin, now time.Time) []string {
+	year, month, day := now.In(config.Location).Date()
+
+	total := 0
+	var best *untappd.Checkin
+	var active string
+	activeCount := 0
+	for user, checkins := range userCheckins {
+		count := 0
+		for _, c := range checkins {
+			y, m, d := c.Created.In(config.Location).Date()
+			if y != year || m != month || d != day {
+				continue
+			}
+			count++
+			if c.UserRating > 0 && (best == nil || c.UserRating > best.UserRating) {
+				best = c
+			}
+		}
+		total += count
+		if count > activeCount || (count == activeCount && count > 0 && user < active) {
+			active = user
+			activeCount = count
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	lines := []string{fmt.Sprintf("Today's summary: %d checkins, most by %s (%d).",
+		total, active, activeCount)}
+	if best != nil {
+		lines = append(lines, fmt.Sprintf("Highest rated: %s (%s), %.2f by %s.",
+			best.Beer.Name, best.Brewery.Name, best.UserRating, best.User.UserName))
+	}
+	return lines
+}
+
+// ThrowbackCommand implements "!throwback".
+func (q *cacheCommands) ThrowbackCommand(nick string, args []string) []string {
+	lines := throwbackLines(q.store.Snapshot(), time.Now())
+	if len(lines) == 0 {
+		return []string{"No checkins from one year ago today."}
+	}
+	return lines
+}
+
+// MostImprovedCommand implements "!mostimproved".
+func (q *cacheCommands) MostImprovedCommand(nick string, args []string) []string {
+	best, ok := mostImproved(q.store.Snapshot())
+	if !ok {
+		return []string{"No beer has gotten better with time (yet)."}
+	}
+
+	return []string{fmt.Sprintf("Most improved: %s (%s), up %0.2f from %0.2f to %0.2f over %d checkins.",
+		best.checkin.Beer.Name, best.checkin.Brewery.Name,
+		best.after-best.before, best.before, best.after, best.count)}
+}
+
+// FavBreweryCommand implements "!favbrewery <user>".
+func (q *cacheCommands) FavBreweryCommand(nick string, args []string) []string {
+	if len(args) == 0 {
+		return usage("favbrewery <user>")
+	}
+
+	user, checkins, ok := q.userCheckins(args[0])
+	if !ok {
+		return []string{fmt.Sprintf("Not tracking %s.", user)}
+	}
+	if len(checkins) < favBreweryMinCheckins {
+		return []string{fmt.Sprintf("%s has too few checkins to have a favorite brewery.", user)}
+	}
+
+	fav, _ := favoriteBrewery(checkins)
+	return []string{fmt.Sprintf("%s's favorite brewery is %s: %d checkins with %0.2f average rating.",
+		user, fav.brewery.Name, fav.count, fav.rating)}
+}
+
+// RecentCommand implements "!recent <user> [n]".
+func (q *cacheCommands) RecentCommand(nick string, args []string) []string {
+	if len(args) == 0 || len(args) > 2 {
+		return usage("recent <user> [n]")
+	}
+	n := recentDefaultCheckins
+	if len(args) == 2 {
+		var err error
+		n, err = strconv.Atoi(args[1])
+		if err != nil || n < 1 || n > recentMaxCheckins {
+			return []string{fmt.Sprintf("n must be between 1 and %d.", recentMaxCheckins)}
+		}
+	}
+
+	user, checkins, ok := q.userCheckins(args[0])
+	if !ok {
+		return []string{fmt.Sprintf("Not tracking %s.", user)}
+	}
+	recent := recentCheckins(checkins, n)
+	if len(recent) == 0 {
+		return []string{fmt.Sprintf("No checkins from %s.", user)}
+	}
+
+	lines := make([]string, 0, len(recent))
+	for _, c := range recent {
+		lines = append(lines, fmt.Sprintf("%s: %s (%s), rated %0.1f on %s.",
+			user, c.Beer.Name, c.Brewery.Name, c.UserRating,
+			c.Created.In(userLocation(user)).Format("Jan 2 15:04")))
+	}
+	return lines
+}
+
+// TrendingCommand implements "!trending".
+func (q *cacheCommands) TrendingCommand(nick string, args []string) []string {
+	since := time.Now().AddDate(0, 0, -7)
+	trending := trendingBeers(q.store.Snapshot(), since, trendingMaxBeers)
+	if len(trending) == 0 {
+		return []string{"Nothing has been checked in this week."}
+	}
+
+	beers := make([]string, 0, len(trending))
+	for _, p := range trending {
+		beers = append(beers, fmt.Sprintf("%s (%s) by %d",
+			p.checkin.Beer.Name, p.checkin.Brewery.Name, p.users))
+	}
+	return []string{fmt.Sprintf("Trending this week: %s", strings.Join(beers, ", "))}
+}
+
+// OutlierCommand implements "!outlier <beer>".
+func (q *cacheCommands) OutlierCommand(nick string, args []string) []string {
+	if len(args) == 0 {
+		return usage("outlier <beer>")
+	}
+
+	userCheckins := q.store.Snapshot()
+	checkin, ok := findCachedBeer(userCheckins, strings.Join(args, " "))
+	if !ok {
+		return []string{fmt.Sprintf("Nobody has had %s.", strings.Join(args, " "))}
+	}
+
+	user, rating, groupAvg, ok := ratingOutlier(userCheckins, checkin.Beer)
+	if !ok {
+		return []string{fmt.Sprintf("Too few of us have rated %s to find an outlier.", checkin.Beer.Name)}
+	}
+
+	return []string{fmt.Sprintf("For %s (avg %0.2f), %s is the outlier at %0.2f.",
+		checkin.Beer.Name, groupAvg, user, rating)}
+}
+
+// CompareCommand implements "!compare <user> <user> <beer>".
+func (q *cacheCommands) CompareCommand(nick string, args []string) []string {
+	if len(args) < 3 {
+		return usage("compare <user> <user> <beer>")
+	}
+
+	users := make([]string, 2)
+	both := make(map[string][]*untappd.Checkin)
+	for i, name := range args[:2] {
+		user, checkins, ok := q.userCheckins(name)
+		if !ok {
+			return []string{fmt.Sprintf("Not tracking %s.", user)}
+		}
+		users[i] = user
+		both[user] = checkins
+	}
+
+	query := strings.Join(args[2:], " ")
+	checkin, ok := findCachedBeer(both, query)
+	if !ok {
+		return []string{fmt.Sprintf("Neither %s nor %s has had %s.", users[0], users[1], query)}
+	}
+
+	ratings := make([]float64, 2)
+	parts := make([]string, 2)
+	for i, user := range users {
+		_, _, avg, count, _ := getStats(both[user], checkin.Beer)
+		switch {
+		case count == 0:
+			parts[i] = fmt.Sprintf("%s hasn't had it", user)
+		case avg == 0:
+			parts[i] = fmt.Sprintf("%s hasn't rated it", user)
+		default:
+			parts[i] = fmt.Sprintf("%s %0.2f", user, avg)
+		}
+		ratings[i] = avg
+	}
+
+	line := fmt.Sprintf("%s: %s, %s", checkin.Beer.Name, parts[0], parts[1])
+	if ratings[0] > 0 && ratings[1] > 0 {
+		line += fmt.Sprintf(" (%+0.2f)", ratings[0]-ratings[1])
+	}
+	return []string{line + "."}
+}
+
+// BeerCountCommand implements "!beercount".
+func (q *cacheCommands) BeerCountCommand(nick string, args []string) []string {
+	checkins, beers, breweries := groupCounts(q.store.Snapshot())
+	return []string{fmt.Sprintf("Together we have %d checkins of %d different beers from %d breweries.",
+		checkins, beers, breweries)}
+}
+
+// FrequencyCommand implements "!frequency <user>".
+func (q *cacheCommands) FrequencyCommand(nick string, args []string) []string {
+	if len(args) == 0 {
+		return usage("frequency <user>")
+	}
+
+	user, checkins, ok := q.userCheckins(args[0])
+	if !ok {
+		return []string{fmt.Sprintf("Not tracking %s.", user)}
+	}
+	if len(checkins) < 2 {
+		return []string{fmt.Sprintf("%s has too few checkins to tell.", user)}
+	}
+
+	first, last := checkins[0].Created, checkins[len(checkins)-1].Created
+	weeks := last.Sub(first).Hours() / (24 * 7)
+	if weeks < 1 {
+		weeks = 1
+	}
+	return []string{fmt.Sprintf("%s checks in %0.1f beers per week (%d checkins since %s).",
+		user, float64(len(checkins))/weeks, len(checkins),
+		first.In(config.Location).Format("02 Jan 2006"))}
+}
+
+// RecommendCommand implements "!recommend <user>".
+func (q *cacheCommands) RecommendCommand(nick string, args []string) []string {
+	if len(args) == 0 {
+		return usage("recommend <user>")
+	}
+
+	user, checkins, ok := q.userCheckins(args[0])
+	if !ok {
+		return []string{fmt.Sprintf("Not tracking %s.", user)}
+	}
+
+	beers := make([]string, 0, recommendMaxBeers)
+	for _, b := range lovedBeers(q.store.Snapshot(), recommendMinRating, recommendMinRaters) {
+		if len(beers) == recommendMaxBeers {
+			break
+		}
+		if !hasHad(checkins, b.checkin.Beer.ID) {
+			beers = append(beers, fmt.Sprintf("%s (%s) %0.2f",
+				b.checkin.Beer.Name, b.checkin.Brewery.Name, b.avg))
+		}
+	}
+
+	if len(beers) == 0 {
+		return []string{fmt.Sprintf("No recommendations for %s, they have had all our favorites.", user)}
+	}
+	return []string{fmt.Sprintf("%s should try: %s", user, strings.Join(beers, ", "))}
+}
+
+// StyleBreakdownCommand implements "!stylebreakdown".
+func (q *cacheCommands) StyleBreakdownCommand(nick string, args []string) []string {
+	all := make([]*untappd.Checkin, 0)
+	for _, checkins := range q.store.Snapshot() {
+		all = append(all, checkins...)
+	}
+	if len(all) == 0 {
+		return []string{"No checkins yet."}
+	}
+
+	top := topStyles(styleHistogram(all), styleBreakdownMaxStyles)
+	return []string{fmt.Sprintf("Our styles: %s", formatStyles(top, len(all), false))}
+}
+
+// StylesCommand implements "!styles <user>".
+func (q *cacheCommands) StylesCommand(nick string, args []string) []string {
+	if len(args) == 0 {
+		return usage("styles <user>")
+	}
+
+	user, checkins, ok := q.userCheckins(args[0])
+	if !ok {
+		return []string{fmt.Sprintf("Not tracking %s.", user)}
+	}
+	if len(checkins) == 0 {
+		return []string{fmt.Sprintf("No checkins from %s.", user)}
+	}
+
+	top := topStyles(styleHistogram(checkins), userStylesMaxStyles)
+	return []string{fmt.Sprintf("%s's styles: %s", user, formatStyles(top, len(checkins), true))}
+}
+
+// formatStyles lists the styles with their share of total checkins, and
+// the number of checkins if withCounts is set.
+func formatStyles(top []styleCount, total int, withCounts bool) string {
+	styles := make([]string, 0, len(top))
+	for _, s := range top {
+		share := 100 * float64(s.count) / float64(total)
+		if withCounts {
+			styles = append(styles, fmt.Sprintf("%s %d (%0.0f%%)", s.style, s.count, share))
+		} else {
+			styles = append(styles, fmt.Sprintf("%s %0.0f%%", s.style, share))
+		}
+	}
+	return strings.Join(styles, ", ")
+}
+
+// NextCommand implements "!next <user>". It suggests a beer the group likes
+// in a style the user rates highly but hasn't had lately.
+func (q *cacheCommands) NextCommand(nick string, args []string) []string {
+	if len(args) == 0 {
+		return usage("next <user>")
+	}
+
+	user, checkins, ok := q.userCheckins(args[0])
+	if !ok {
+		return []string{fmt.Sprintf("Not tracking %s.", user)}
+	}
+
+	loved := lovedBeers(q.store.Snapshot(), recommendMinRating, 1)
+	for _, style := range styleRatings(checkins, nextMinRated) {
+		if time.Since(style.last) < nextRecent {
+			continue
+		}
+		for _, b := range loved {
+			if b.checkin.Beer.Style == style.style && !hasHad(checkins, b.checkin.Beer.ID) {
+				return []string{fmt.Sprintf("%s likes %s (avg %0.2f) and hasn't had one lately. Next up: %s (%s), rated %0.2f by us.",
+					user, style.style, style.avg, b.checkin.Beer.Name, b.checkin.Brewery.Name, b.avg)}
+			}
+		}
+	}
+
+	return []string{fmt.Sprintf("No suggestion for %s, try %srecommend instead.", user, config.CommandPrefix)}
+}
+
+// StandingCommand implements "!standing <user>".
+func (q *cacheCommands) StandingCommand(nick string, args []string) []string {
+	if len(args) == 0 {
+		return usage("standing <user>")
+	}
+
+	user, ok := trackedUser(args[0])
+	if !ok {
+		return []string{fmt.Sprintf("Not tracking %s.", args[0])}
+	}
+
+	userCheckins := q.store.Snapshot()
+	byRating, byCount := standing(userCheckins, user)
+	return []string{fmt.Sprintf("%s is %s of %d by average rating, %s by volume.",
+		user, ordinal(byRating), len(userCheckins), ordinal(byCount))}
+}
+
+// LeaderboardCommand implements "!leaderboard".
+func (q *cacheCommands) LeaderboardCommand(nick string, args []string) []string {
+	entries := buildLeaderboard(q.store.Snapshot())
+	if len(entries) == 0 {
+		return []string{"No checkins yet."}
+	}
+
+	lines := make([]string, 0, leaderboardMaxUsers)
+	for i, e := range entries[:min(leaderboardMaxUsers, len(entries))] {
+		lines = append(lines, fmt.Sprintf("%d. %s %0.2f (%d checkins)", i+1, e.user, e.average, e.count))
+	}
+	return lines
+}
+
+// MostToastedCommand implements "!mosttoasted".
+func (q *cacheCommands) MostToastedCommand(nick string, args []string) []string {
+	var best *untappd.Checkin
+	for _, checkins := range q.store.Snapshot() {
+		for _, c := range checkins {
+			if len(c.Toasts) > 0 && (best == nil || len(c.Toasts) > len(best.Toasts)) {
+				best = c
+			}
+		}
+	}
+
+	if best == nil {
+		return []string{"Nobody has been toasted yet."}
+	}
+	return []string{fmt.Sprintf("Most toasted: %s's %s (%s) with %d toasts.",
+		best.User.UserName, best.Beer.Name, best.Brewery.Name, len(best.Toasts))}
+}
+
+// WordyCommand implements "!wordy [user]", showing the longest comment of
+// the user or of the whole group.
+func (q *cacheCommands) WordyCommand(nick string, args []string) []string {
+	checkins := make([]*untappd.Checkin, 0)
+	who := "anyone"
+	if len(args) > 0 {
+		user, cs, ok := q.userCheckins(args[0])
+		if !ok {
+			return []string{fmt.Sprintf("Not tracking %s.", user)}
+		}
+		checkins, who = cs, user
+	} else {
+		for _, cs := range q.store.Snapshot() {
+			checkins = append(checkins, cs...)
+		}
+	}
+
+	c, ok := longestComment(checkins)
+	if !ok {
+		return []string{fmt.Sprintf("No comments from %s.", who)}
+	}
+	return []string{fmt.Sprintf("Wordiest: %s on %s (%d characters): \"%s\"",
+		c.User.UserName, c.Beer.Name, utf8.RuneCountInString(c.Comment),
+		truncate(c.Comment, wordyPreviewLength))}
+}
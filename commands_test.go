@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/untappd"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+func TestCommandHandlerDoesNotBlock(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config = Config{Channels: stringList{"#beer"}, CommandPrefix: "!"}
+
+	release := make(chan struct{})
+	commands := map[string]commandFunc{
+		"slow": func(nick string, args []string) []string {
+			<-release
+			return []string{"done " + nick}
+		},
+	}
+	replies := make(chan targetedMessage)
+	handler := CommandHandler(commands, replies)
+
+	handled := make(chan struct{})
+	go func() {
+		handler(nil, irc.ParseMessage(":bob!b@host PRIVMSG #beer :!slow"))
+		close(handled)
+	}()
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("handler blocked on a slow command")
+	}
+
+	close(release)
+	select {
+	case reply := <-replies:
+		if reply.target != "#beer" || reply.text != "done bob" {
+			t.Errorf("got %+v, want the reply in #beer", reply)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no reply")
+	}
+}
+
+func TestFullStatsCommandPaste(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, err := r.FormFile("file"); err != nil {
+			t.Errorf("no stats uploaded: %s", err)
+		}
+		fmt.Fprintln(w, "https://paste.example/abc")
+	}))
+	defer server.Close()
+	config = Config{PasteURL: server.URL}
+
+	store := newCheckinStore()
+	store.Set("alice", testCheckins("alice", 1, 3))
+	q := &cacheCommands{store: store, private: make(chan targetedMessage, 20)}
+	reply := q.FullStatsCommand("bob", nil)
+	if len(reply) != 1 || reply[0] != "Full stats: https://paste.example/abc" {
+		t.Errorf("got %q, want the link", reply)
+	}
+	if len(q.private) != 0 {
+		t.Errorf("sent %d private lines, want none", len(q.private))
+	}
+}
+
+func TestFullStatsCommandPrivate(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config = Config{}
+
+	store := newCheckinStore()
+	for i := 0; i < 15; i++ {
+		user := fmt.Sprintf("user%02d", i)
+		store.Set(user, testCheckins(user, i*10, 2))
+	}
+	q := &cacheCommands{store: store, private: make(chan targetedMessage, 20)}
+	reply := q.FullStatsCommand("bob", nil)
+	if !strings.Contains(reply[0], "privately") {
+		t.Errorf("got %q, want the stats sent privately", reply)
+	}
+	if n := len(q.private); n != fullStatsMaxLines+1 {
+		t.Errorf("sent %d lines, want %d and a truncation mark", n, fullStatsMaxLines+1)
+	}
+	for len(q.private) > 0 {
+		if m := <-q.private; m.target != "bob" {
+			t.Errorf("sent a line to %s, want bob", m.target)
+		}
+	}
+}
+
+func TestBuildDailySummary(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config = Config{Location: loadLocation(t, "Europe/Oslo")}
+	now := time.Date(2021, 3, 10, 23, 0, 0, 0, config.Location)
+
+	userCheckins := map[string][]*untappd.Checkin{
+		"alice": {
+			testCheckin(1, "alice", 1, 3.5, time.Date(2021, 3, 10, 18, 0, 0, 0, time.UTC)),
+			// Just before midnight in Oslo, so yesterday's
+			testCheckin(2, "alice", 2, 5, time.Date(2021, 3, 9, 22, 30, 0, 0, time.UTC)),
+		},
+		"bob": {
+			testCheckin(3, "bob", 3, 4.25, time.Date(2021, 3, 10, 12, 0, 0, 0, time.UTC)),
+			testCheckin(4, "bob", 4, 0, time.Date(2021, 3, 10, 13, 0, 0, 0, time.UTC)),
+			// Already tomorrow in Oslo
+			testCheckin(5, "bob", 5, 4.5, time.Date(2021, 3, 10, 23, 30, 0, 0, time.UTC)),
+		},
+	}
+	lines := buildDailySummary(userCheckins, now)
+	want := []string{
+		"Today's summary: 3 checkins, most by bob (2).",
+		"Highest rated: Beer 3 (Brewery 3), 4.25 by bob.",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", lines, want)
+	}
+
+	if lines := buildDailySummary(userCheckins, now.AddDate(0, 0, 2)); lines != nil {
+		t.Errorf("got %q on a day without checkins, want nothing", lines)
+	}
+}
+
+func TestCompareCommand(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config = Config{Users: []User{{Name: "alice"}, {Name: "bob"}, {Name: "carol"}}}
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	store := newCheckinStore()
+	store.Set("alice", []*untappd.Checkin{
+		testCheckin(1, "alice", 1, 4, start),
+		testCheckin(2, "alice", 1, 3, start.Add(time.Hour)),
+		testCheckin(3, "alice", 2, 0, start.Add(2*time.Hour)),
+	})
+	store.Set("bob", []*untappd.Checkin{testCheckin(4, "bob", 1, 4.25, start)})
+	q := &cacheCommands{store: store}
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"alice", "bob", "beer", "1"}, "Beer 1: alice 3.50, bob 4.25 (-0.75)."},
+		{[]string{"Bob", "alice", "beer 1"}, "Beer 1: bob 4.25, alice 3.50 (+0.75)."},
+		{[]string{"alice", "carol", "beer 1"}, "Beer 1: alice 3.50, carol hasn't had it."},
+		{[]string{"bob", "alice", "beer 2"}, "Beer 2: bob hasn't had it, alice hasn't rated it."},
+		{[]string{"bob", "carol", "beer 9"}, "Neither bob nor carol has had beer 9."},
+		{[]string{"alice", "dave", "beer 1"}, "Not tracking dave."},
+	}
+	for _, tt := range tests {
+		if reply := q.CompareCommand("erin", tt.args); len(reply) != 1 || reply[0] != tt.want {
+			t.Errorf("%v: got %q, want %q", tt.args, reply, tt.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// dashboardUser is a row of the dashboard.
+type dashboardUser struct {
+	Name        string    `json:"name"`
+	Checkins    int       `json:"checkins"`
+	Average     float64   `json:"average"`
+	Stdev       float64   `json:"stdev"`
+	LastCheckin time.Time `json:"last_checkin"`
+}
+
+// dashboardUsers returns the statistics of every cached user, by name.
+func dashboardUsers(store *checkinStore) []dashboardUser {
+	users := make([]dashboardUser, 0)
+	for name, checkins := range store.Snapshot() {
+		count, mean, stdev := getUserStats(checkins)
+		user := dashboardUser{Name: name, Checkins: count, Average: mean, Stdev: stdev}
+		for _, c := range checkins {
+			if c.Created.After(user.LastCheckin) {
+				user.LastCheckin = c.Created
+			}
+		}
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>untappdtoirc</title></head>
+<body>
+<table>
+<tr><th>User</th><th>Checkins</th><th>Average</th><th>Stdev</th><th>Last checkin</th></tr>
+{{range .}}<tr><td>{{.Name}}</td><td>{{.Checkins}}</td><td>{{printf "%0.2f" .Average}}</td><td>{{printf "%0.2f" .Stdev}}</td><td>{{if not .LastCheckin.IsZero}}{{.LastCheckin.Format "2006-01-02 15:04"}}{{end}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// serveDashboard serves a read-only page with the statistics of the
+// tracked users at addr, and the same as json on /users.json.
+func serveDashboard(addr string, store *checkinStore) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := dashboardTemplate.Execute(w, dashboardUsers(store)); err != nil {
+			warnf("Unable to render dashboard: %s", err)
+		}
+	})
+	mux.HandleFunc("/users.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(dashboardUsers(store)); err != nil {
+			warnf("Unable to write dashboard json: %s", err)
+		}
+	})
+	infof("Serving dashboard on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		warnf("Unable to serve dashboard: %s", err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdlayher/untappd"
+)
+
+// Time format of created_at in untappd data exports, in UTC.
+const exportTimeFormat = "2006-01-02 15:04:05"
+
+// readExport reads the checkins of a user from an untappd data export,
+// which can be either the json or the csv version.
+func readExport(userName string, fileName string) ([]*untappd.Checkin, error) {
+	body, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []map[string]string
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		records, err = readJSONExport(trimmed)
+	} else {
+		records, err = readCSVExport(body)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fileName, err)
+	}
+
+	checkins := make([]*untappd.Checkin, 0, len(records))
+	for i, record := range records {
+		c, err := exportCheckin(userName, record)
+		if err != nil {
+			return nil, fmt.Errorf("%s: checkin %d: %s", fileName, i+1, err)
+		}
+		checkins = append(checkins, c)
+	}
+	return checkins, nil
+}
+
+// readJSONExport reads the records of a json export. Values are converted
+// to strings, as in the csv export.
+func readJSONExport(body []byte) ([]map[string]string, error) {
+	var raw []map[string]interface{}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+
+	records := make([]map[string]string, 0, len(raw))
+	for _, r := range raw {
+		record := make(map[string]string, len(r))
+		for key, value := range r {
+			if value != nil {
+				record[key] = fmt.Sprint(value)
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// readCSVExport reads the records of a csv export, keyed by the header.
+func readCSVExport(body []byte) ([]map[string]string, error) {
+	rows, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	header := rows[0]
+	records := make([]map[string]string, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		record := make(map[string]string, len(header))
+		for i, key := range header {
+			if i < len(row) {
+				record[key] = row[i]
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// exportCheckin maps a record of a data export to a checkin.
+func exportCheckin(userName string, record map[string]string) (*untappd.Checkin, error) {
+	var err error
+	number := func(key string) float64 {
+		v := strings.TrimSpace(record[key])
+		if v == "" || err != nil {
+			return 0
+		}
+		var f float64
+		f, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			err = fmt.Errorf("%s: %s", key, err)
+		}
+		return f
+	}
+
+	c := &untappd.Checkin{
+		ID:         int(number("checkin_id")),
+		Comment:    record["comment"],
+		UserRating: number("rating_score"),
+		User:       &untappd.User{UserName: userName},
+		Beer: &untappd.Beer{
+			ID:    int(number("bid")),
+			Name:  record["beer_name"],
+			Style: record["beer_type"],
+			ABV:   number("beer_abv"),
+			IBU:   int(number("beer_ibu")),
+		},
+		Brewery: &untappd.Brewery{
+			ID:      int(number("brewery_id")),
+			Name:    record["brewery_name"],
+			Country: record["brewery_country"],
+		},
+	}
+	if record["venue_name"] != "" {
+		c.Venue = &untappd.Venue{
+			ID:   int(number("venue_id")),
+			Name: record["venue_name"],
+			Location: untappd.VenueLocation{
+				City:      record["venue_city"],
+				State:     record["venue_state"],
+				Country:   record["venue_country"],
+				Latitude:  number("venue_lat"),
+				Longitude: number("venue_lng"),
+			},
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.ID == 0 {
+		return nil, fmt.Errorf("missing checkin_id")
+	}
+
+	c.Created, err = time.Parse(exportTimeFormat, record["created_at"])
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// configMu guards the config fields which can be changed at runtime with
+// !set. They are read with getFlag or enabled, never directly.
+var configMu sync.RWMutex
+
+// usersMu guards config.Users, which can be changed at runtime with !track
+// and !untrack.
+var usersMu sync.RWMutex
+
+// featureFlags returns the boolean config fields which can be changed at
+// runtime, by their name in the config file.
+func featureFlags() map[string]*bool {
+	return map[string]*bool{
+		"colors":                &config.Colors,
+		"ping_linked_users":     &config.PingLinkedUsers,
+		"show_new_releases":     &config.ShowNewReleases,
+		"show_first_in_channel": &config.ShowFirstInChannel,
+		"show_friend_ratings":   &config.ShowFriendRatings,
+		"show_revisits":         &config.ShowRevisits,
+		"show_group_sessions":   &config.ShowGroupSessions,
+		"show_overtakes":        &config.ShowOvertakes,
+		"show_milestones":       &config.ShowMilestones,
+		"show_social":           &config.ShowSocial,
+		"show_community_rating": &config.ShowCommunityRating,
+		"announce_deletions":    &config.AnnounceDeletions,
+	}
+}
+
+func featureFlagNames() string {
+	names := make([]string, 0)
+	for name := range featureFlags() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// getFlag returns the current value of a feature flag.
+func getFlag(name string) (bool, bool) {
+	flag, ok := featureFlags()[strings.ToLower(name)]
+	if !ok {
+		return false, false
+	}
+
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return *flag, true
+}
+
+// enabled returns whether a feature flag is on.
+func enabled(name string) bool {
+	value, _ := getFlag(name)
+	return value
+}
+
+// setFlag changes a feature flag.
+func setFlag(name string, value bool) bool {
+	flag, ok := featureFlags()[strings.ToLower(name)]
+	if !ok {
+		return false
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+	*flag = value
+	return true
+}
+
+// applyFlags sets the feature flags saved in the settings. It must be
+// called before the untappd loop is started.
+func applyFlags(flags map[string]bool) {
+	for name, value := range flags {
+		if flag, ok := featureFlags()[name]; ok {
+			*flag = value
+		} else {
+			warnf("Ignoring unknown feature flag %s in settings.", name)
+		}
+	}
+}
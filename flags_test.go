@@ -0,0 +1,92 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSetFlag(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config = Config{}
+
+	if !setFlag("Show_Social", true) {
+		t.Fatal("want show_social to be a flag")
+	}
+	// Applied before setFlag returns
+	if value, ok := getFlag("show_social"); !ok || !value || !enabled("show_social") {
+		t.Errorf("got %v, %v, want show_social on", value, ok)
+	}
+	if setFlag("show_photos", true) {
+		t.Error("want unknown flags refused")
+	}
+	if _, ok := getFlag("show_photos"); ok || enabled("show_photos") {
+		t.Error("want unknown flags off")
+	}
+}
+
+func TestSetFlagWhileAnnouncing(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config = Config{Location: time.UTC, MaxCommentLength: 200}
+	checkin := testCheckin(1, "alice", 1, 4, time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+
+	// Run with -race to check that flags are read safely
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			setFlag("show_community_rating", i%2 == 0)
+			setFlag("colors", i%3 == 0)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			logCheckin(checkin)
+		}
+	}()
+	wg.Wait()
+}
+
+func TestSetColors(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config = Config{}
+
+	if bold("Pliny") != "Pliny" {
+		t.Error("got bold text with colors off")
+	}
+	setFlag("colors", true)
+	if bold("Pliny") == "Pliny" || colored(colorGreen, "4.5") == "4.5" {
+		t.Error("want formatting after turning colors on")
+	}
+}
+
+func TestSetCommandSaves(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config = Config{}
+
+	a := &adminCommands{settings: &settingsStore{}}
+	if reply := a.SetCommand("op", []string{"show_social", "true"}); !strings.Contains(reply[0], "settings_file") {
+		t.Errorf("got %q without a settings file, want to be told it isn't kept", reply)
+	}
+
+	fileName := filepath.Join(t.TempDir(), "settings.json")
+	settings, err := loadSettings(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a = &adminCommands{settings: settings}
+	if reply := a.SetCommand("op", []string{"show_social", "false"}); reply[0] != "show_social is now false." {
+		t.Errorf("got %q", reply)
+	}
+	reloaded, err := loadSettings(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := reloaded.get().Flags["show_social"]; !ok || value {
+		t.Errorf("got %v, %v saved, want show_social off", value, ok)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"math"
+
+	"github.com/mdlayher/untappd"
+)
+
+// Mean radius of the earth in kilometers.
+const earthRadiusKm float64 = 6371
+
+// distanceKm returns the great-circle distance between two coordinates,
+// given in degrees.
+func distanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+// nearbyDistance returns the distance from the home coordinate to the
+// venue, if config.NearbyRadiusKm is set and the venue is within it.
+// Venues without coordinates are never nearby.
+func nearbyDistance(venue *untappd.Venue) (float64, bool) {
+	if config.NearbyRadiusKm <= 0 || venue == nil {
+		return 0, false
+	}
+	loc := venue.Location
+	if loc.Latitude == 0 && loc.Longitude == 0 {
+		return 0, false
+	}
+	d := distanceKm(config.HomeLat, config.HomeLon, loc.Latitude, loc.Longitude)
+	return d, d <= config.NearbyRadiusKm
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nickvanw/ircx/v2"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+// Time to wait before rejoining a channel the bot was kicked from.
+const rejoinDelay = 10 * time.Second
+
+// currentNick is the nick the bot has on the server, which is not
+// config.BotName if that was taken.
+var currentNick = struct {
+	sync.Mutex
+	name string
+}{}
+
+func setNick(name string) {
+	currentNick.Lock()
+	defer currentNick.Unlock()
+	currentNick.name = name
+}
+
+func getNick() string {
+	currentNick.Lock()
+	defer currentNick.Unlock()
+	if currentNick.name == "" {
+		return config.BotName
+	}
+	return currentNick.name
+}
+
+// ErrorHandler logs why the server is closing the connection, like a ban
+// or being killed. handleConnection reconnects once it is closed.
+func ErrorHandler(s ircx.Sender, m *irc.Message) {
+	warnf("Server closing the connection: %s", m.Trailing())
+}
+
+// KillHandler logs who killed the bot's connection and why.
+func KillHandler(s ircx.Sender, m *irc.Message) {
+	by := ""
+	if m.Prefix != nil {
+		by = m.Prefix.Name
+	}
+	warnf("Killed by %s: %s", by, m.Trailing())
+}
+
+// KickHandler rejoins a channel after rejoinDelay when the bot is kicked.
+func KickHandler(s ircx.Sender, m *irc.Message) {
+	channel := m.Param(0)
+	if !isChannel(channel) || !strings.EqualFold(m.Param(1), getNick()) {
+		return
+	}
+
+	warnf("Kicked from %s: %s. Rejoining in %s.", channel, m.Trailing(), rejoinDelay)
+	time.AfterFunc(rejoinDelay, func() {
+		s.Send(&irc.Message{
+			Command: irc.JOIN,
+			Params:  []string{channel},
+		})
+	})
+}
+
+// NickInUseHandler tries another nick, with an underscore appended, when
+// the one asked for is taken.
+func NickInUseHandler(s ircx.Sender, m *irc.Message) {
+	nick := m.Param(1) + "_"
+	warnf("Nick %s is in use, trying %s.", m.Param(1), nick)
+	s.Send(&irc.Message{
+		Command: irc.NICK,
+		Params:  []string{nick},
+	})
+}
+
+// NickChangeHandler follows changes of the bot's own nick.
+func NickChangeHandler(s ircx.Sender, m *irc.Message) {
+	if m.Prefix != nil && strings.EqualFold(m.Prefix.Name, getNick()) {
+		setNick(m.Param(0))
+	}
+}
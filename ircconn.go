@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nickvanw/ircx/v2"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+// How long the connection may be silent before it is considered lost. The
+// server pings well within this.
+const ircReadTimeout = 300 * time.Second
+
+// ircSender sends messages on the connection made by connect.
+type ircSender struct {
+	encoder *irc.Encoder
+}
+
+func (s ircSender) Send(m *irc.Message) error {
+	return s.encoder.Encode(m)
+}
+
+var errNotConnected = errors.New("not connected to irc")
+
+// sharedSender sends on the latest connection. It is the bot's Sender for
+// good, so that the goroutines sending to irc keep working across
+// reconnects.
+type sharedSender struct {
+	mu      sync.Mutex
+	current ircx.Sender
+}
+
+func (s *sharedSender) set(sender ircx.Sender) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current = sender
+}
+
+func (s *sharedSender) Send(m *irc.Message) error {
+	s.mu.Lock()
+	current := s.current
+	s.mu.Unlock()
+	if current == nil {
+		return errNotConnected
+	}
+	return current.Send(m)
+}
+
+// connect connects the bot to the irc server and registers, starting to
+// authenticate with SASL first if sasl isn't nil. This replaces
+// bot.Connect, which sends NICK and USER before anything else: CAP LS must
+// come first for the server to hold the registration until CAP END.
+// Messages read are passed to bot.Data, which is closed when the
+// connection is lost. bot.Sender is set on the first connect, and switched
+// over to the new connection by the later ones.
+func connect(bot *ircx.Bot, sasl *saslAuth) error {
+	var conn net.Conn
+	var err error
+	if bot.Config.TLSConfig == nil {
+		conn, err = net.Dial("tcp", bot.Server)
+	} else {
+		conn, err = tls.Dial("tcp", bot.Server, bot.Config.TLSConfig)
+	}
+	if err != nil {
+		return err
+	}
+
+	sender := ircSender{encoder: irc.NewEncoder(conn)}
+	if sasl != nil {
+		sasl.start(sender)
+	}
+	for _, m := range registration(bot) {
+		if err := sender.Send(m); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	if shared, ok := bot.Sender.(*sharedSender); ok {
+		shared.set(sender)
+	} else {
+		bot.Sender = &sharedSender{current: sender}
+	}
+	go readIrc(conn, bot.Data)
+	return nil
+}
+
+// registration returns the messages registering the bot with the server.
+func registration(bot *ircx.Bot) []*irc.Message {
+	messages := make([]*irc.Message, 0, 3)
+	if bot.Config.Password != "" {
+		messages = append(messages, &irc.Message{Command: irc.PASS, Params: []string{bot.Config.Password}})
+	}
+	return append(messages,
+		&irc.Message{Command: irc.NICK, Params: []string{bot.OriginalName}},
+		&irc.Message{Command: irc.USER, Params: []string{bot.Config.User, "0", "*", bot.Config.User}})
+}
+
+// readIrc passes the messages read from conn to data until the connection
+// is lost, then closes both.
+func readIrc(conn net.Conn, data chan<- *irc.Message) {
+	defer close(data)
+	defer conn.Close()
+
+	decoder := irc.NewDecoder(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(ircReadTimeout))
+		m, err := decoder.Decode()
+		if err != nil {
+			debugw("Irc connection lost", "error", err)
+			return
+		}
+		if m != nil {
+			data <- m
+		}
+	}
+}
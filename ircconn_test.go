@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nickvanw/ircx/v2"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+// connectTest connects a bot to a local server and returns the first n
+// lines the server reads, and the server's end of the connection.
+func connectTest(t *testing.T, sasl *saslAuth, n int) (*ircx.Bot, []string, net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	bot := ircx.Classic(listener.Addr().String(), "untappdbot")
+	if err := connect(bot, sasl); err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(server)
+	lines := make([]string, 0, n)
+	for len(lines) < n {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read %q, then: %s", lines, err)
+		}
+		lines = append(lines, line)
+	}
+	return bot, lines, server
+}
+
+func TestConnectSendsCapFirst(t *testing.T) {
+	_, lines, server := connectTest(t, newSASLAuth("untappdbot", "secret"), 3)
+	defer server.Close()
+	want := []string{"CAP LS 302\r\n", "NICK untappdbot\r\n", "USER untappdbot 0 * untappdbot\r\n"}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Fatalf("got %q, want %q", lines, want)
+		}
+	}
+}
+
+func TestConnectWithoutSASL(t *testing.T) {
+	bot, lines, server := connectTest(t, nil, 2)
+	if lines[0] != "NICK untappdbot\r\n" {
+		t.Errorf("got %q, want to register right away", lines)
+	}
+
+	server.Write([]byte(":irc.example.org 001 untappdbot :Welcome\r\n"))
+	select {
+	case m := <-bot.Data:
+		if m.Command != irc.RPL_WELCOME {
+			t.Errorf("got %s, want the welcome", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message passed on")
+	}
+
+	server.Close()
+	select {
+	case _, ok := <-bot.Data:
+		if ok {
+			t.Error("got a message after the connection was lost")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("data not closed when the connection was lost")
+	}
+}
+
+func TestSenderSurvivesReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	bot := ircx.Classic(listener.Addr().String(), "untappdbot")
+	accept := func() net.Conn {
+		if err := connect(bot, nil); err != nil {
+			t.Fatal(err)
+		}
+		server, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.SetDeadline(time.Now().Add(5 * time.Second))
+		return server
+	}
+
+	first := accept()
+	sender := bot.Sender
+	stop := make(chan struct{})
+	sending := make(chan struct{})
+	go func() {
+		defer close(sending)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				sender.Send(&irc.Message{Command: irc.PRIVMSG, Params: []string{"#beer", "hello"}})
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-sending
+	}()
+
+	// Reconnect the way handleConnection does
+	first.Close()
+	for range bot.Data {
+	}
+	bot.Data = make(chan *irc.Message, 10)
+	second := accept()
+	defer second.Close()
+
+	if bot.Sender != sender {
+		t.Error("got a new sender after reconnecting, want the same one")
+	}
+	reader := bufio.NewReader(second)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("no message on the new connection: %s", err)
+		}
+		if line == "PRIVMSG #beer hello\r\n" {
+			break
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/nickvanw/ircx/v2"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+// linkStore keeps track of which irc nick has claimed which untappd user
+// (through !link), and which nicks are currently in which channels. The
+// links are saved in the settings.
+type linkStore struct {
+	mu       sync.Mutex
+	settings *settingsStore
+	nicks    map[string]string          // untappd user -> irc nick
+	present  map[string]map[string]bool // lower cased nick -> lower cased channels
+}
+
+func newLinkStore(settings *settingsStore) *linkStore {
+	l := &linkStore{
+		settings: settings,
+		nicks:    make(map[string]string),
+		present:  make(map[string]map[string]bool),
+	}
+	for user, nick := range settings.get().Links {
+		l.nicks[user] = nick
+	}
+	return l
+}
+
+// save writes the links to the settings. Must be called with the lock
+// held.
+func (l *linkStore) save() {
+	links := make(map[string]string, len(l.nicks))
+	for user, nick := range l.nicks {
+		links[user] = nick
+	}
+	if err := l.settings.update(func(s *settings) { s.Links = links }); err != nil {
+		warnf("Unable to save settings: %s", err)
+	}
+}
+
+// link associates nick with the untappd user, replacing any earlier link
+// held by either of them.
+func (l *linkStore) link(nick string, user string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for u, n := range l.nicks {
+		if strings.EqualFold(n, nick) {
+			delete(l.nicks, u)
+		}
+	}
+	l.nicks[user] = nick
+	l.save()
+}
+
+// unlink removes the link held by nick and returns the untappd user it
+// was linked to.
+func (l *linkStore) unlink(nick string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for u, n := range l.nicks {
+		if strings.EqualFold(n, nick) {
+			delete(l.nicks, u)
+			l.save()
+			return u, true
+		}
+	}
+	return "", false
+}
+
+// nickFor returns the irc nick linked to the untappd user, but only if
+// that nick is currently in one of the channels.
+func (l *linkStore) nickFor(user string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for u, nick := range l.nicks {
+		if strings.EqualFold(u, user) && len(l.present[strings.ToLower(nick)]) > 0 {
+			return nick, true
+		}
+	}
+	return "", false
+}
+
+// setPresent records whether nick is in the channel.
+func (l *linkStore) setPresent(nick string, channel string, present bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	nick, channel = strings.ToLower(nick), strings.ToLower(channel)
+	if present {
+		if l.present[nick] == nil {
+			l.present[nick] = make(map[string]bool)
+		}
+		l.present[nick][channel] = true
+		return
+	}
+	delete(l.present[nick], channel)
+	if len(l.present[nick]) == 0 {
+		delete(l.present, nick)
+	}
+}
+
+// left records that nick has left every channel.
+func (l *linkStore) left(nick string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.present, strings.ToLower(nick))
+}
+
+// leftChannel records that everyone has left the channel, as seen by the
+// bot when it leaves it.
+func (l *linkStore) leftChannel(channel string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for nick, channels := range l.present {
+		delete(channels, strings.ToLower(channel))
+		if len(channels) == 0 {
+			delete(l.present, nick)
+		}
+	}
+}
+
+func (l *linkStore) rename(oldNick string, newNick string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if channels, ok := l.present[strings.ToLower(oldNick)]; ok {
+		delete(l.present, strings.ToLower(oldNick))
+		l.present[strings.ToLower(newNick)] = channels
+	}
+	renamed := false
+	for u, n := range l.nicks {
+		if strings.EqualFold(n, oldNick) {
+			l.nicks[u] = newNick
+			renamed = true
+		}
+	}
+	if renamed {
+		l.save()
+	}
+}
+
+// LinkCommand implements "!link <untappd user> [nick]". Linking needs an
+// operator, who can link themselves or the given nick, so that nobody can
+// claim another's untappd account. Without an argument it removes the
+// caller's current link.
+func (l *linkStore) LinkCommand(nick string, args []string) []string {
+	if len(args) == 0 {
+		if user, ok := l.unlink(nick); ok {
+			return []string{fmt.Sprintf("%s is no longer linked to %s.", nick, user)}
+		}
+		return usage("link <untappd user> [nick]")
+	}
+
+	user, ok := trackedUser(args[0])
+	if !ok {
+		return []string{fmt.Sprintf("Not tracking %s.", args[0])}
+	}
+
+	if !isOperator(nick) {
+		return []string{fmt.Sprintf("%s: ask an operator to link you with %slink %s %s.",
+			nick, config.CommandPrefix, user, nick)}
+	}
+	if len(args) > 1 {
+		nick = args[1]
+	}
+
+	l.link(nick, user)
+	return []string{fmt.Sprintf("%s is now linked to %s.", nick, user)}
+}
+
+func (l *linkStore) NamesHandler(s ircx.Sender, m *irc.Message) {
+	for _, name := range strings.Fields(m.Trailing()) {
+		l.setPresent(strings.TrimLeft(name, "~&@%+"), m.Param(2), true)
+	}
+}
+
+func (l *linkStore) JoinHandler(s ircx.Sender, m *irc.Message) {
+	if m.Prefix != nil && isChannel(m.Param(0)) {
+		l.setPresent(m.Prefix.Name, m.Param(0), true)
+	}
+}
+
+func (l *linkStore) PartHandler(s ircx.Sender, m *irc.Message) {
+	if m.Prefix == nil || !isChannel(m.Param(0)) {
+		return
+	}
+	if strings.EqualFold(m.Prefix.Name, getNick()) {
+		l.leftChannel(m.Param(0))
+	} else {
+		l.setPresent(m.Prefix.Name, m.Param(0), false)
+	}
+}
+
+func (l *linkStore) KickHandler(s ircx.Sender, m *irc.Message) {
+	if !isChannel(m.Param(0)) {
+		return
+	}
+	if strings.EqualFold(m.Param(1), getNick()) {
+		l.leftChannel(m.Param(0))
+	} else {
+		l.setPresent(m.Param(1), m.Param(0), false)
+	}
+}
+
+func (l *linkStore) QuitHandler(s ircx.Sender, m *irc.Message) {
+	if m.Prefix != nil {
+		l.left(m.Prefix.Name)
+	}
+}
+
+func (l *linkStore) NickHandler(s ircx.Sender, m *irc.Message) {
+	if m.Prefix != nil {
+		l.rename(m.Prefix.Name, m.Param(0))
+	}
+}
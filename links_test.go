@@ -0,0 +1,78 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+func TestLinkPresencePerChannel(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config = Config{Channels: stringList{"#beer", "#pub"}}
+
+	l := newLinkStore(&settingsStore{})
+	l.link("Bob", "bobby")
+	l.JoinHandler(nil, irc.ParseMessage(":Bob!b@host JOIN #beer"))
+	l.JoinHandler(nil, irc.ParseMessage(":Bob!b@host JOIN #pub"))
+
+	l.PartHandler(nil, irc.ParseMessage(":Bob!b@host PART #beer"))
+	if _, ok := l.nickFor("bobby"); !ok {
+		t.Error("bob left one channel, want him still present in the other")
+	}
+	l.KickHandler(nil, irc.ParseMessage(":op!o@host KICK #pub Bob :out"))
+	if _, ok := l.nickFor("bobby"); ok {
+		t.Error("bob left both channels, want him absent")
+	}
+
+	l.NamesHandler(nil, irc.ParseMessage(":server 353 untappdbot = #pub :@op +Bob"))
+	l.NickHandler(nil, irc.ParseMessage(":Bob!b@host NICK Robert"))
+	if nick, ok := l.nickFor("bobby"); !ok || nick != "Robert" {
+		t.Errorf("got %q, %v after a nick change, want Robert", nick, ok)
+	}
+	l.QuitHandler(nil, irc.ParseMessage(":Robert!b@host QUIT :bye"))
+	if _, ok := l.nickFor("bobby"); ok {
+		t.Error("bob quit, want him absent")
+	}
+}
+
+func TestLinksSaved(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "settings.json")
+	settings, err := loadSettings(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newLinkStore(settings).link("Bob", "bobby")
+
+	reloaded, err := loadSettings(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLinkStore(reloaded)
+	l.setPresent("bob", "#beer", true)
+	if nick, ok := l.nickFor("bobby"); !ok || nick != "Bob" {
+		t.Errorf("got %q, %v after a restart, want Bob", nick, ok)
+	}
+}
+
+func TestLinkCommandNeedsOperator(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config = Config{Users: []User{{Name: "bobby"}}, Operators: []string{"op"}, CommandPrefix: "!"}
+
+	l := newLinkStore(&settingsStore{})
+	if reply := l.LinkCommand("mallory", []string{"bobby"}); !strings.Contains(reply[0], "ask an operator") {
+		t.Errorf("got %q, want linking refused", reply)
+	}
+	if reply := l.LinkCommand("mallory", []string{"bobby", "mallory"}); !strings.Contains(reply[0], "ask an operator") {
+		t.Errorf("got %q, want linking refused", reply)
+	}
+	if len(l.nicks) != 0 {
+		t.Fatalf("got links %v, want none", l.nicks)
+	}
+
+	l.LinkCommand("op", []string{"bobby", "Bob"})
+	if l.nicks["bobby"] != "Bob" {
+		t.Errorf("got links %v, want bobby linked to Bob", l.nicks)
+	}
+}
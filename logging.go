@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// logLevel is the minimum level of the messages written to the log.
+type logLevel int32
+
+const (
+	debugLevel logLevel = iota
+	infoLevel
+	warnLevel
+)
+
+var logLevelNames = []string{"debug", "info", "warn"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	return infoLevel, fmt.Errorf("unknown log level %q", s)
+}
+
+var currentLogLevel = int32(infoLevel)
+
+func setLogLevel(l logLevel) {
+	atomic.StoreInt32(&currentLogLevel, int32(l))
+}
+
+func getLogLevel() logLevel {
+	return logLevel(atomic.LoadInt32(&currentLogLevel))
+}
+
+// Log as one json object per line instead of text. Set at startup from
+// config.LogFormat.
+var jsonLogs bool
+
+func setLogFormat(format string) error {
+	switch strings.ToLower(format) {
+	case "", "text":
+		jsonLogs = false
+	case "json":
+		jsonLogs = true
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	return nil
+}
+
+// fileLog gets the messages below warnLevel instead of the standard log,
+// and a copy of the warnings, when config.LogFile is set.
+var fileLog *log.Logger
+
+func setLogFile(w io.Writer) {
+	fileLog = log.New(w, "", log.LstdFlags)
+}
+
+// logw writes msg with key/value fields, like
+// logw(infoLevel, "Got checkins", "user", "peter", "count", 25).
+func logw(l logLevel, msg string, keyvals ...interface{}) {
+	if l < getLogLevel() {
+		return
+	}
+
+	std := log.Default()
+	if fileLog != nil {
+		if l >= warnLevel {
+			writeLog(std, l, msg, keyvals)
+		}
+		std = fileLog
+	}
+	writeLog(std, l, msg, keyvals)
+}
+
+func writeLog(logger *log.Logger, l logLevel, msg string, keyvals []interface{}) {
+	var b bytes.Buffer
+	if jsonLogs {
+		b.WriteString("{")
+		writeJSONField(&b, "time", time.Now().Format(time.RFC3339))
+		b.WriteString(",")
+		writeJSONField(&b, "level", l.String())
+		b.WriteString(",")
+		writeJSONField(&b, "msg", msg)
+		for i := 0; i+1 < len(keyvals); i += 2 {
+			b.WriteString(",")
+			writeJSONField(&b, fmt.Sprint(keyvals[i]), keyvals[i+1])
+		}
+		b.WriteString("}\n")
+		logger.Writer().Write(b.Bytes())
+		return
+	}
+
+	fmt.Fprintf(&b, "%-5s %s", strings.ToUpper(l.String()), msg)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fmt.Fprintf(&b, " %s=%v", keyvals[i], keyvals[i+1])
+	}
+	logger.Print(b.String())
+}
+
+func writeJSONField(b *bytes.Buffer, key string, value interface{}) {
+	k, _ := json.Marshal(key)
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case fmt.Stringer:
+		value = v.String()
+	}
+	v, err := json.Marshal(value)
+	if err != nil {
+		v, _ = json.Marshal(fmt.Sprint(value))
+	}
+	b.Write(k)
+	b.WriteString(":")
+	b.Write(v)
+}
+
+func logf(l logLevel, format string, v ...interface{}) {
+	logw(l, fmt.Sprintf(format, v...))
+}
+
+func debugf(format string, v ...interface{}) { logf(debugLevel, format, v...) }
+func infof(format string, v ...interface{})  { logf(infoLevel, format, v...) }
+func warnf(format string, v ...interface{})  { logf(warnLevel, format, v...) }
+
+func debugw(msg string, keyvals ...interface{}) { logw(debugLevel, msg, keyvals...) }
+func infow(msg string, keyvals ...interface{})  { logw(infoLevel, msg, keyvals...) }
+func warnw(msg string, keyvals ...interface{})  { logw(warnLevel, msg, keyvals...) }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mdlayher/untappd"
+)
+
+// errLookupLimited is returned when the lookup commands have used up
+// their api calls.
+var errLookupLimited = errors.New("too many lookups")
+
+// lookupCommands implements the commands which call the untappd api. They
+// share a token bucket, so that users can't use up the calls the poll loop
+// needs.
+type lookupCommands struct {
+	client *untappd.Client
+	budget *apiBudget
+	bucket *tokenBucket
+	beers  *beerCache
+}
+
+func newLookupCommands(client *untappd.Client, budget *apiBudget) *lookupCommands {
+	return &lookupCommands{
+		client: client,
+		budget: budget,
+		bucket: newTokenBucket(config.LookupsPerHour, time.Hour),
+		beers:  newBeerCache(beerCacheSize, config.BeerTTL),
+	}
+}
+
+// allow takes the tokens for n api calls, if both the bucket and the
+// hourly budget have them.
+func (l *lookupCommands) allow(n int) bool {
+	if remaining, _ := l.budget.remaining(time.Now()); remaining < n {
+		return false
+	}
+	return l.bucket.take(n, time.Now())
+}
+
+// getBeer returns the info on a beer, from the cache if it has been looked
+// up recently.
+func (l *lookupCommands) getBeer(id int) (*untappd.Beer, error) {
+	if beer, ok := l.beers.get(id, time.Now()); ok {
+		return beer, nil
+	}
+	if !l.allow(1) {
+		return nil, errLookupLimited
+	}
+
+	l.budget.use(time.Now())
+	beer, resp, err := l.client.Beer.Info(id, true)
+	l.budget.report(resp, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	l.beers.put(beer, time.Now())
+	return beer, nil
+}
+
+// BeerCommand implements "!beer <search terms>".
+func (l *lookupCommands) BeerCommand(nick string, args []string) []string {
+	if len(args) == 0 {
+		return usage("beer <search terms>")
+	}
+	if !l.allow(1) {
+		return []string{fmt.Sprintf("%s: rate limited, try again shortly.", nick)}
+	}
+
+	query := strings.Join(args, " ")
+	l.budget.use(time.Now())
+	beers, resp, err := l.client.Beer.SearchOffsetLimitSort(query, 0, 1, untappd.SortCheckin)
+	l.budget.report(resp, time.Now())
+	if err != nil {
+		warnf("Unable to search for %q: %s", query, err)
+		return []string{"Unable to search untappd right now."}
+	}
+	if len(beers) == 0 {
+		return []string{fmt.Sprintf("No beer found for %s.", query)}
+	}
+
+	// The search results don't have the beer's rating
+	beer, err := l.getBeer(beers[0].ID)
+	if err == errLookupLimited {
+		return []string{fmt.Sprintf("%s: rate limited, try again shortly.", nick)}
+	}
+	if err != nil {
+		warnf("Unable to get info on beer %d: %s", beers[0].ID, err)
+		return []string{"Unable to look up the beer right now."}
+	}
+
+	brewery := ""
+	if beer.Brewery != nil {
+		brewery = beer.Brewery.Name
+	} else if beers[0].Brewery != nil {
+		brewery = beers[0].Brewery.Name
+	}
+	return []string{fmt.Sprintf("%s (%s)  Style: %s   ABV: %0.1f%%   Rating: %0.2f",
+		beer.Name, brewery, beer.Style, beer.ABV, beer.OverallRating)}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	b := newTokenBucket(3, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if !b.take(1, now) {
+			t.Fatalf("took %d tokens of 3, want a burst of 3", i)
+		}
+	}
+	if b.take(1, now) {
+		t.Error("took a 4th token, want the bucket empty")
+	}
+
+	// One token comes back every 20 minutes
+	if b.take(1, now.Add(19*time.Minute)) {
+		t.Error("took a token after 19 minutes")
+	}
+	if !b.take(1, now.Add(20*time.Minute)) {
+		t.Error("no token after 20 minutes")
+	}
+
+	// But never more than the capacity
+	later := now.Add(24 * time.Hour)
+	if b.take(4, later) || !b.take(3, later) {
+		t.Error("want 3 tokens after a day, not more")
+	}
+}
+
+func TestLookupRateLimited(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config = Config{LookupsPerHour: 1}
+
+	l := newLookupCommands(nil, newApiBudget(ApiCallsPerHour))
+	l.bucket.take(1, time.Now())
+	reply := l.BeerCommand("bob", []string{"pliny"})
+	if len(reply) != 1 || !strings.Contains(reply[0], "rate limited") {
+		t.Errorf("got %q, want the lookup refused", reply)
+	}
+
+	// Out of api calls for the hour, whatever the bucket has left
+	l = newLookupCommands(nil, newApiBudget(0))
+	if reply := l.BeerCommand("bob", []string{"pliny"}); !strings.Contains(reply[0], "rate limited") {
+		t.Errorf("got %q without api calls left, want the lookup refused", reply)
+	}
+}
@@ -1,13 +1,24 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
 	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/jpillora/backoff"
 	"github.com/mdlayher/untappd"
@@ -21,102 +32,986 @@ type Config struct {
 	Users        []User
 	BotName      string `json:"bot_name"`
 	Server       string
-	Channel      string
+	// Connect to the irc server with TLS (default true). Without it the
+	// password for SASL or NickServ, and everything said in the channels,
+	// is sent in the clear.
+	TLS bool `json:"tls"`
+	// Accept any certificate from the irc server, like a self-signed one.
+	// This allows anyone who can intercept the connection to impersonate
+	// the server, so prefer adding the certificate to the system's trust
+	// store.
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+	// Channels to join. Checkins are announced in all of them, commands
+	// are answered in the channel they are given in. A single name is
+	// accepted too, as is the older "channel".
+	Channels stringList `json:"channels"`
+	Channel  string
+	// Password to identify to NickServ with before joining, for a
+	// registered bot_name. NickServName is the service's nick, by default
+	// NickServ.
+	NickServPassword string `json:"nickserv_password"`
+	NickServName     string `json:"nickserv_name"`
+	// Account to authenticate with SASL PLAIN while connecting. SASLUser
+	// is bot_name by default.
+	SASLUser     string `json:"sasl_user"`
+	SASLPassword string `json:"sasl_password"`
 	TimeZone     string `json:"time_zone"`
 	Location     *time.Location
+	// Mention the irc nick linked (with !link) to the user whose
+	// checkin is announced.
+	PingLinkedUsers bool `json:"ping_linked_users"`
+	// Announce beers new to the group from breweries the group has
+	// had before.
+	ShowNewReleases bool `json:"show_new_releases"`
+	// Announce when a user is the first of the group to have a beer.
+	ShowFirstInChannel bool `json:"show_first_in_channel"`
+	// Paste service used by !fullstats. The stats are uploaded as a
+	// multipart form field and the response body is the link.
+	PasteURL   string `json:"paste_url"`
+	PasteField string `json:"paste_field"`
+	// Time of day ("15:04" in time_zone) to post checkins from one year
+	// ago. Leave empty to only post on !throwback.
+	ThrowbackTime string `json:"throwback_time"`
+	Throwback     clock  `json:"-"`
+	// Time of day ("15:04" in time_zone) to post a summary of the day's
+	// checkins. Leave empty to not post it.
+	SummaryTime string `json:"summary_time"`
+	Summary     clock  `json:"-"`
+	// Only announce checkins at (or not at) these venues, given by name
+	// or venue ID. Filtered checkins are still cached.
+	IncludeVenues []string `json:"include_venues"`
+	ExcludeVenues []string `json:"exclude_venues"`
+	// Mark checkins at these venues, given by name or venue ID.
+	HighlightVenues []string `json:"highlight_venues"`
+	// Show the distance to venues within NearbyRadiusKm of the home
+	// coordinate.
+	HomeLat        float64 `json:"home_lat"`
+	HomeLon        float64 `json:"home_lon"`
+	NearbyRadiusKm float64 `json:"nearby_radius_km"`
+	// Daily window ("15:04" in time_zone) during which untappd is not
+	// polled.
+	MaintenanceStart string  `json:"maintenance_start"`
+	MaintenanceEnd   string  `json:"maintenance_end"`
+	Maintenance      *window `json:"-"`
+	// Show the other users' ratings of an announced beer (default true),
+	// at most MaxPeerRatings of them if it is set, picking those who had
+	// it most recently. MaxFriendRatingsShown is the older name.
+	ShowFriendRatings     bool `json:"show_friend_ratings"`
+	MaxPeerRatings        int  `json:"max_peer_ratings"`
+	MaxFriendRatingsShown int  `json:"max_friend_ratings_shown"`
+	// Also show the average of the other users' ratings weighted by age,
+	// halving the weight for every RatingHalfLife ("2160h").
+	RatingHalfLife string        `json:"rating_half_life"`
+	HalfLife       time.Duration `json:"-"`
+	// Time to wait between messages sent to irc, like "2s" (the
+	// default), to avoid being kicked for flooding.
+	MessageInterval string        `json:"message_interval"`
+	Throttle        time.Duration `json:"-"`
+	// Condense rapidMinCheckins or more checkins by a user, each within
+	// this time ("90s") of the one before, into one announcement.
+	RapidWindow string        `json:"rapid_window"`
+	Rapid       time.Duration `json:"-"`
+	// Prefix of the bot commands, default "!". Commands can also be
+	// given by addressing the bot ("untappdbot: stats").
+	CommandPrefix string `json:"command_prefix"`
+	// Number of untappd api calls per hour the commands calling the api
+	// may make between them, default budgetReserve.
+	LookupsPerHour int `json:"lookups_per_hour"`
+	// How long beers looked up on untappd are cached, like "24h" (the
+	// default).
+	BeerCacheTTL string        `json:"beer_cache_ttl"`
+	BeerTTL      time.Duration `json:"-"`
+	// Irc nicks allowed to use the admin commands.
+	Operators []string `json:"operators"`
+	// Log level (debug, info or warn), default info.
+	LogLevel string `json:"log_level"`
+	// Log format, "text" (default) or "json".
+	LogFormat string `json:"log_format"`
+	// File to write debug and info messages to instead of stderr, which
+	// then only gets warnings. It is rotated when it grows past
+	// LogFileMaxMB megabytes (default 10), keeping LogFileKeep (default
+	// 3) old files.
+	LogFile      string `json:"log_file"`
+	LogFileMaxMB int    `json:"log_file_max_mb"`
+	LogFileKeep  int    `json:"log_file_keep"`
+	// File where settings changed at runtime are saved.
+	SettingsFile string `json:"settings_file"`
+	// When a poll finds more than BatchThreshold new checkins, only the
+	// BatchAnnounceCount most recent are announced in full and the rest
+	// are summarized in one line.
+	BatchThreshold     int `json:"batch_threshold"`
+	BatchAnnounceCount int `json:"batch_announce_count"`
+	// Announce when a user rates a beer they have had before differently.
+	ShowRevisits bool `json:"show_revisits"`
+	// Mark ratings more than this many standard deviations from the
+	// user's average rating. Off when 0.
+	OutlierSigma float64 `json:"outlier_sigma"`
+	// Announce checkins which have been deleted from untappd. They are
+	// always removed from the cache.
+	AnnounceDeletions bool `json:"announce_deletions"`
+	// Number of checkins fetched for each user at startup, at most (and
+	// by default) CheckinApiLimit.
+	InitialFetchCount int `json:"initial_fetch_count"`
+	// Announce when several users check in at the same venue together.
+	ShowGroupSessions bool `json:"show_group_sessions"`
+	// Announce when a user passes another in number of checkins.
+	ShowOvertakes bool `json:"show_overtakes"`
+	// Announce when a user reaches one of Milestones total checkins,
+	// by default 100, 250, 500, 1000, 2500, 5000 and 10000.
+	ShowMilestones bool  `json:"show_milestones"`
+	Milestones     []int `json:"milestones"`
+	// How the statistics of the users are posted at startup: "each" user
+	// on their own line (default), "combined" in as few lines as possible,
+	// or "off".
+	StartupStats string `json:"startup_stats"`
+	// Show the number of toasts and comments on announced checkins.
+	ShowSocial bool `json:"show_social"`
+	// Show the beer's rating on untappd next to the user's rating.
+	ShowCommunityRating bool `json:"show_community_rating"`
+	// Post announced checkins as json to this url, signed with
+	// WebhookSecret (HMAC-SHA256, in the X-Signature-256 header).
+	WebhookURL    string `json:"webhook_url"`
+	WebhookSecret string `json:"webhook_secret"`
+	// Only answer commands, never announce checkins. For running a
+	// second instance next to the one announcing.
+	ObserverMode bool `json:"observer_mode"`
+	// Number of failed attempts in a row to reconnect to irc before
+	// giving up, default 10.
+	MaxReconnects int `json:"max_reconnects"`
+	// Number of failed untappd api calls in a row before posting that
+	// untappd is unreachable, default 5.
+	UnreachableAfter int `json:"unreachable_after"`
+	// Address to serve prometheus metrics on, e.g. ":9090".
+	MetricsAddr string `json:"metrics_addr"`
+	// Address to serve a page with the statistics of the users on.
+	WebAddr string `json:"web_addr"`
+	// Don't announce checkins rated below this. They are still cached, and
+	// unrated checkins are always announced.
+	MinRating float64 `json:"min_rating"`
+	// File where the cached checkins are saved after each poll, so that
+	// only new checkins are fetched after a restart.
+	CacheFile string `json:"cache_file"`
+	// Go templates of the lines of an announced checkin, replacing the
+	// built-in format.
+	Templates checkinTemplates `json:"templates"`
+	// Lines of a checkin to announce, out of checkinFields. All of them
+	// by default.
+	Fields      []string        `json:"fields"`
+	ShownFields map[string]bool `json:"-"`
+	// Comments of announced checkins are cut to this many characters,
+	// default 200.
+	MaxCommentLength int `json:"max_comment_length"`
+	// Use mIRC colors and bold text in the checkin announcements.
+	Colors bool `json:"colors"`
+	// Set the topic of the channels to the latest checkin, at most once
+	// per poll cycle.
+	UpdateTopic bool `json:"update_topic"`
+}
+
+// stringList is a list of strings in the config, which can also be given
+// as a single string.
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*l = stringList{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(l))
 }
 
 type User struct {
 	Name string
+	// Optional untappd data export (json or csv) with the user's full
+	// history, beyond what the api allows fetching.
+	Export string `json:"export"`
+	// Optional time zone the user's checkins are shown in, instead of
+	// the global time_zone.
+	TimeZone string         `json:"time_zone"`
+	Location *time.Location `json:"-"`
+	// Optional number of checkins fetched at startup, instead of
+	// initial_fetch_count. Untappd only returns more than
+	// CheckinApiLimit for the account the api key is authorized for.
+	HistoryLimit int `json:"history_limit"`
 }
 
 var config Config
 
+// Version of the build, set with -ldflags "-X main.version=1.2.3".
+var version = "dev"
+
 // The untappd api limits how many checkins you can query on other users.
 // Limit is 300 at the moment.
 const CheckinApiLimit int = 300
 
+// Number of checkins asked for in each request. Untappd returns at most 50
+// per request, and may return fewer even when there are more.
+const checkinsPageSize int = 50
+
+// How long to wait for the poll loop to stop when shutting down.
+const shutdownTimeout = 10 * time.Second
+
+// How long to wait for an answer from the untappd api. Without a timeout
+// a hanging connection would stall polling, or a !beer lookup, forever.
+const apiTimeout = 30 * time.Second
+
 func readConfigFile(fileName string) (Config, error) {
+	root := Config{ShowFriendRatings: true, TLS: true}
 	body, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return root, err
+	}
 
-	var root Config
 	err = json.Unmarshal(body, &root)
 	if err != nil {
-		return root, err
+		return root, fmt.Errorf("%s: %s", fileName, err)
+	}
+
+	if root.Channel != "" {
+		root.Channels = append(stringList{root.Channel}, root.Channels...)
+	}
+
+	if root.MaxPeerRatings == 0 {
+		root.MaxPeerRatings = root.MaxFriendRatingsShown
+	}
+
+	if len(root.Milestones) == 0 {
+		root.Milestones = []int{100, 250, 500, 1000, 2500, 5000, 10000}
+	}
+
+	if root.MaxReconnects == 0 {
+		root.MaxReconnects = 10
+	}
+
+	if root.UnreachableAfter == 0 {
+		root.UnreachableAfter = 5
+	}
+
+	if root.SASLUser == "" {
+		root.SASLUser = root.BotName
+	}
+
+	if root.NickServName == "" {
+		root.NickServName = "NickServ"
+	}
+
+	if root.CommandPrefix == "" {
+		root.CommandPrefix = "!"
+	}
+
+	root.BeerTTL = 24 * time.Hour
+	if root.BeerCacheTTL != "" {
+		root.BeerTTL, err = time.ParseDuration(root.BeerCacheTTL)
+		if err != nil {
+			return root, fmt.Errorf("beer_cache_ttl: %s", err)
+		}
+	}
+
+	if root.MaxCommentLength == 0 {
+		root.MaxCommentLength = 200
+	}
+	if root.MaxCommentLength < 2 {
+		return root, fmt.Errorf("max_comment_length must be at least 2")
+	}
+
+	if root.LookupsPerHour == 0 {
+		root.LookupsPerHour = budgetReserve
+	}
+	if root.LookupsPerHour < 0 || root.LookupsPerHour > ApiCallsPerHour {
+		return root, fmt.Errorf("lookups_per_hour must be between 1 and %d", ApiCallsPerHour)
 	}
 
 	root.Location, err = time.LoadLocation(root.TimeZone)
 	if err != nil {
 		return root, err
 	}
+	resolveLocations(root.Users, root.Location)
+
+	if root.LogFileMaxMB == 0 {
+		root.LogFileMaxMB = 10
+	}
+	if root.LogFileKeep == 0 {
+		root.LogFileKeep = 3
+	}
+	if root.LogFileMaxMB < 0 || root.LogFileKeep < 0 {
+		return root, fmt.Errorf("log_file_max_mb and log_file_keep must be positive")
+	}
+
+	if err := setLogFormat(root.LogFormat); err != nil {
+		return root, err
+	}
+
+	if root.LogLevel != "" {
+		if _, err := parseLogLevel(root.LogLevel); err != nil {
+			return root, err
+		}
+	}
+
+	// The untappd api only allows you to get the lastest 300 checkins
+	// for other users (for non-obvious reasons).
+	if root.InitialFetchCount == 0 {
+		root.InitialFetchCount = CheckinApiLimit
+	}
+	if root.InitialFetchCount < 0 || root.InitialFetchCount > CheckinApiLimit {
+		return root, fmt.Errorf("initial_fetch_count must be between 1 and %d", CheckinApiLimit)
+	}
+	for _, user := range root.Users {
+		if user.HistoryLimit < 0 {
+			return root, fmt.Errorf("history_limit of %s must be positive", user.Name)
+		}
+	}
+
+	switch root.StartupStats {
+	case "":
+		root.StartupStats = "each"
+	case "each", "combined", "off":
+	default:
+		return root, fmt.Errorf("startup_stats must be each, combined or off")
+	}
+
+	if root.OutlierSigma < 0 {
+		return root, fmt.Errorf("outlier_sigma must be positive")
+	}
+
+	if root.MinRating < 0 || root.MinRating > 5 {
+		return root, fmt.Errorf("min_rating must be between 0 and 5")
+	}
+
+	if root.BatchAnnounceCount < 0 || root.BatchAnnounceCount > root.BatchThreshold {
+		return root, fmt.Errorf("batch_announce_count must be between 0 and batch_threshold")
+	}
+
+	if root.MaintenanceStart != "" || root.MaintenanceEnd != "" {
+		start, err := parseClock(root.MaintenanceStart)
+		if err != nil {
+			return root, fmt.Errorf("maintenance_start: %s", err)
+		}
+		end, err := parseClock(root.MaintenanceEnd)
+		if err != nil {
+			return root, fmt.Errorf("maintenance_end: %s", err)
+		}
+		root.Maintenance = &window{start, end}
+	}
+
+	root.Throttle = 2 * time.Second
+	if root.MessageInterval != "" {
+		root.Throttle, err = time.ParseDuration(root.MessageInterval)
+		if err != nil {
+			return root, fmt.Errorf("message_interval: %s", err)
+		}
+		if root.Throttle <= 0 {
+			return root, fmt.Errorf("message_interval must be positive")
+		}
+	}
+
+	if root.RatingHalfLife != "" {
+		root.HalfLife, err = time.ParseDuration(root.RatingHalfLife)
+		if err != nil {
+			return root, fmt.Errorf("rating_half_life: %s", err)
+		}
+		if root.HalfLife <= 0 {
+			return root, fmt.Errorf("rating_half_life must be positive")
+		}
+	}
+
+	if root.RapidWindow != "" {
+		root.Rapid, err = time.ParseDuration(root.RapidWindow)
+		if err != nil {
+			return root, fmt.Errorf("rapid_window: %s", err)
+		}
+	}
+
+	if root.Server != "" {
+		root.Server, err = parseServer(root.Server, root.TLS)
+		if err != nil {
+			return root, err
+		}
+	}
+
+	if len(root.Fields) == 0 {
+		root.Fields = checkinFields
+	}
+	root.ShownFields = make(map[string]bool)
+	for _, field := range root.Fields {
+		if !containsString(checkinFields, field) {
+			return root, fmt.Errorf("unknown field %q, must be one of %s",
+				field, strings.Join(checkinFields, ", "))
+		}
+		root.ShownFields[field] = true
+	}
+
+	if err := root.Templates.compile(); err != nil {
+		return root, err
+	}
+
+	if root.ThrowbackTime != "" {
+		root.Throwback, err = parseClock(root.ThrowbackTime)
+		if err != nil {
+			return root, err
+		}
+	}
+
+	if root.SummaryTime != "" {
+		root.Summary, err = parseClock(root.SummaryTime)
+		if err != nil {
+			return root, err
+		}
+	}
 
 	return root, nil
 }
 
-func isCheckinNew(checkin *untappd.Checkin, checkins []*untappd.Checkin) bool {
-	for _, c := range checkins {
-		if c.ID == checkin.ID {
-			return false
+// ignoredUsers returns the names of the users in the config file that are
+// not in the saved list of users, which replaces it.
+func ignoredUsers(configured []User, saved []User) []string {
+	ignored := make([]string, 0)
+	for _, c := range configured {
+		found := false
+		for _, s := range saved {
+			if strings.EqualFold(c.Name, s.Name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ignored = append(ignored, c.Name)
 		}
 	}
+	return ignored
+}
 
-	return true
+// resolveLocations sets the Location of each user from their TimeZone,
+// falling back to the global location.
+func resolveLocations(users []User, fallback *time.Location) {
+	for i := range users {
+		user := &users[i]
+		user.Location = fallback
+		if user.TimeZone == "" {
+			continue
+		}
+		if loc, err := time.LoadLocation(user.TimeZone); err == nil {
+			user.Location = loc
+		} else {
+			warnf("Invalid time zone for %s, using %s: %s", user.Name, fallback, err)
+		}
+	}
+}
+
+// Ports of the irc server when the config doesn't give one.
+const defaultTLSPort = "6697"
+const defaultPlainPort = "6667"
+
+// parseServer checks the irc server address, which is a host name or IP
+// address with an optional port, and returns it as host:port. IPv6
+// addresses may be given with or without brackets when there is no port.
+func parseServer(server string, useTLS bool) (string, error) {
+	host, port := server, defaultTLSPort
+	if !useTLS {
+		port = defaultPlainPort
+	}
+	bare := server
+	if strings.HasPrefix(server, "[") && strings.HasSuffix(server, "]") {
+		bare = server[1 : len(server)-1]
+	}
+	if ip := net.ParseIP(bare); ip != nil {
+		host = ip.String()
+	} else if strings.Contains(server, ":") {
+		var err error
+		host, port, err = net.SplitHostPort(server)
+		if err != nil {
+			return "", fmt.Errorf("server %q: %s", server, err)
+		}
+	}
+
+	if host == "" || strings.ContainsAny(host, " /[]") {
+		return "", fmt.Errorf("server %q: invalid host", server)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("server %q: invalid port %q", server, port)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// validate checks that the settings needed to connect to untappd and irc
+// are there, naming all that are missing.
+func (c Config) validate() error {
+	missing := make([]string, 0)
+	if c.ClientId == "" {
+		missing = append(missing, "client_id")
+	}
+	if c.ClientSecret == "" {
+		missing = append(missing, "client_secret")
+	}
+	if c.Server == "" {
+		missing = append(missing, "server")
+	}
+	if c.BotName == "" {
+		missing = append(missing, "bot_name")
+	}
+	if len(c.Channels) == 0 {
+		missing = append(missing, "channel")
+	}
+	if len(c.Users) == 0 {
+		missing = append(missing, "users")
+	}
+	for i, user := range c.Users {
+		if user.Name == "" {
+			missing = append(missing, fmt.Sprintf("users[%d].name", i))
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required config: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// trackedUsers returns a copy of the users, which can be changed at runtime
+// with !track and !untrack.
+func trackedUsers() []User {
+	usersMu.RLock()
+	defer usersMu.RUnlock()
+	return append([]User(nil), config.Users...)
+}
+
+// trackedUser returns the configured spelling of the untappd user name,
+// if that user is tracked.
+func trackedUser(name string) (string, bool) {
+	for _, user := range trackedUsers() {
+		if strings.EqualFold(user.Name, name) {
+			return user.Name, true
+		}
+	}
+	return "", false
+}
+
+// isChannel returns true if name is one of the configured channels.
+func isChannel(name string) bool {
+	for _, channel := range config.Channels {
+		if strings.EqualFold(channel, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// historyLimit returns the number of checkins fetched for a user when
+// filling the cache.
+func historyLimit(name string) int {
+	for _, user := range trackedUsers() {
+		if strings.EqualFold(user.Name, name) && user.HistoryLimit > 0 {
+			return user.HistoryLimit
+		}
+	}
+	return config.InitialFetchCount
 }
 
+// userLocation returns the time zone to show the checkins of a user in.
+func userLocation(name string) *time.Location {
+	for _, user := range trackedUsers() {
+		if strings.EqualFold(user.Name, name) && user.Location != nil {
+			return user.Location
+		}
+	}
+	return config.Location
+}
+
+// deletedCheckins returns the cached checkins which are missing from the
+// latest checkins fetched from untappd, although they are within the range
+// fetched. These have been deleted by the user.
+func deletedCheckins(fetched []*untappd.Checkin, cached []*untappd.Checkin) []*untappd.Checkin {
+	if len(fetched) == 0 {
+		return nil
+	}
+
+	oldest := fetched[0].ID
+	ids := make(map[int]bool, len(fetched))
+	for _, c := range fetched {
+		ids[c.ID] = true
+		if c.ID < oldest {
+			oldest = c.ID
+		}
+	}
+
+	deleted := make([]*untappd.Checkin, 0)
+	for _, c := range cached {
+		if c.ID >= oldest && !ids[c.ID] {
+			deleted = append(deleted, c)
+		}
+	}
+	return deleted
+}
+
+// checkinFields are the lines of an announced checkin, as returned by
+// formatCheckin.
+var checkinFields = []string{"general", "style", "rating", "venue"}
+
 func formatCheckin(checkin *untappd.Checkin) (string, string, string, string) {
 	generalInfo := fmt.Sprintf("untappd alert for %s: %s (%s).",
 		checkin.User.UserName,
-		checkin.Beer.Name,
+		bold(checkin.Beer.Name),
 		checkin.Brewery.Name)
 	styleInfo := fmt.Sprintf("  Style: %s   ABV: %0.1f%%",
 		checkin.Beer.Style, checkin.Beer.ABV)
-	ratingInfo := fmt.Sprintf("  Rating: %0.1f   %s",
-		checkin.UserRating,
-		checkin.Comment)
+	rating := fmt.Sprintf("%0.1f", checkin.UserRating)
+	if checkin.UserRating > 0 {
+		rating = colored(ratingColor(checkin.UserRating), rating)
+	}
+	// Untappd doesn't always include it with the checkin
+	if enabled("show_community_rating") && checkin.Beer.OverallRating > 0 {
+		rating += fmt.Sprintf(" (community %0.2f)", checkin.Beer.OverallRating)
+	}
+	ratingInfo := fmt.Sprintf("  Rating: %s   %s",
+		rating,
+		truncate(checkin.Comment, config.MaxCommentLength))
 	venueInfo := ""
 	if checkin.Venue != nil {
-		venueInfo = fmt.Sprintf("  Venue: %s", checkin.Venue.Name)
+		venueInfo = execute(config.Templates.venue, checkin,
+			fmt.Sprintf("  Venue: %s", colored(colorTeal, checkin.Venue.Name)))
 	}
 
-	return generalInfo, styleInfo, ratingInfo, venueInfo
+	return execute(config.Templates.general, checkin, generalInfo),
+		execute(config.Templates.style, checkin, styleInfo),
+		execute(config.Templates.rating, checkin, ratingInfo),
+		venueInfo
+}
+
+// Maximum length, in runes, of the list of badges earned on a checkin.
+const badgesMaxLength int = 200
+
+// formatBadges lists the badges earned on a checkin, or returns an empty
+// string if there are none. Untappd includes the level in the name. The
+// client may leave some of the badges nil, which are skipped.
+func formatBadges(checkin *untappd.Checkin) string {
+	names := make([]string, 0, len(checkin.Badges))
+	for _, b := range checkin.Badges {
+		if b != nil && b.Name != "" {
+			names = append(names, b.Name)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	return truncate(fmt.Sprintf("  🏅 Earned: %s", strings.Join(names, ", ")), badgesMaxLength)
+}
+
+// formatSocial formats the number of toasts and comments on a checkin, to
+// be appended to the rating line. It is empty if there are none.
+func formatSocial(checkin *untappd.Checkin) string {
+	parts := make([]string, 0, 2)
+	if n := len(checkin.Toasts); n > 0 {
+		parts = append(parts, fmt.Sprintf("👍 %d toasts", n))
+	}
+	if n := len(checkin.Comments); n > 0 {
+		parts = append(parts, fmt.Sprintf("💬 %d comments", n))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "  " + strings.Join(parts, ", ")
 }
 
 func main() {
 	var err error
-	config, err = readConfigFile("./config.json")
+	configFile := flag.String("config", "./config.json", "path to the config file")
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	dryRun := flag.Bool("dryrun", false, "log messages instead of sending them to irc")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println("untappdtoirc", version)
+		return
+	}
+
+	config, err = readConfigFile(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := config.validate(); err != nil {
+		log.Fatal(err)
+	}
+	if config.LogFile != "" {
+		f, err := openRotatingFile(config.LogFile, int64(config.LogFileMaxMB)<<20, config.LogFileKeep)
+		if err != nil {
+			log.Fatal(err)
+		}
+		setLogFile(f)
+	}
+
+	settings, err := loadSettings(config.SettingsFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	bot := ircx.WithTLS(config.Server, config.BotName, nil)
-	bot.Config.MaxRetries = 10
+	// Settings changed at runtime take precedence over the config file
+	for _, name := range []string{config.LogLevel, settings.get().LogLevel} {
+		if level, err := parseLogLevel(name); err == nil {
+			setLogLevel(level)
+		}
+	}
+	applyFlags(settings.get().Flags)
+	if users := settings.get().Users; len(users) > 0 {
+		if ignored := ignoredUsers(config.Users, users); len(ignored) > 0 {
+			warnf("Using the users saved in %s, which don't include %s from the config file. Add them with %strack.",
+				config.SettingsFile, strings.Join(ignored, ", "), config.CommandPrefix)
+		}
+		resolveLocations(users, config.Location)
+		config.Users = users
+	}
+
+	// Stop on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var bot *ircx.Bot
+	if config.TLS {
+		bot = ircx.WithTLS(config.Server, config.BotName,
+			&tls.Config{InsecureSkipVerify: config.InsecureSkipVerify})
+	} else {
+		warnf("Connecting to %s without TLS.", config.Server)
+		bot = ircx.Classic(config.Server, config.BotName)
+	}
+	// Reconnecting is done by handleConnection, which ircx leaves to us when
+	// it is not retrying itself
+	bot.Config.MaxRetries = 0
 	bot.SetLogger(bot.Logger())
-	if err := bot.Connect(); err != nil {
+	var sasl *saslAuth
+	if config.SASLPassword != "" {
+		sasl = newSASLAuth(config.SASLUser, config.SASLPassword)
+		sasl.RegisterHandlers(bot)
+	}
+	if err := connect(bot, sasl); err != nil {
 		log.Fatal("Unable to dial IRC Server ", err)
 	}
 
-	RegisterHandlers(bot)
+	if config.MetricsAddr != "" {
+		go serveMetrics(config.MetricsAddr)
+	}
 
-	// Channel for messages to be pushed to irc
+	// Channels for messages to be pushed to irc
 	ircMessages := make(chan string, 30)
-	go pushMessage(bot, ircMessages, config.Channel)
-	go untappdLoop(ircMessages)
+	targetedMessages := make(chan targetedMessage, 30)
+	topics := make(chan string, 5)
+	store := newCheckinStore()
+	links := newLinkStore(settings)
+	if config.WebAddr != "" {
+		go serveDashboard(config.WebAddr, store)
+	}
+
+	client, err := untappd.NewClient(
+		config.ClientId,
+		config.ClientSecret,
+		&http.Client{Timeout: apiTimeout},
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Shared by everything calling the untappd api
+	budget := newApiBudget(ApiCallsPerHour)
+
+	RegisterHandlers(bot, store, links, settings, budget, newLookupCommands(client, budget), targetedMessages)
+
+	var sink messageSink = newIrcSink(bot.Sender, config.Throttle)
+	if *dryRun {
+		infof("Dry run, writing messages to the log instead of irc.")
+		sink = logSink{}
+	}
+	go pushMessage(ctx, sink, ircMessages, targetedMessages, topics, config.Channels)
+	var webhooks chan *untappd.Checkin
+	if config.WebhookURL != "" && !config.ObserverMode {
+		webhooks = make(chan *untappd.Checkin, 30)
+		go webhookLoop(webhooks)
+	}
 
-	bot.HandleLoop()
-	log.Println("Exiting..")
+	// In observer mode the untappd loop only keeps the cache up to date,
+	// and nothing it says is posted to irc.
+	feed := ircMessages
+	if config.ObserverMode {
+		feed = make(chan string)
+		go func() {
+			for message := range feed {
+				debugf("Observer mode, not posting: %s", message)
+			}
+		}()
+	}
+
+	if !config.UpdateTopic || config.ObserverMode {
+		topics = nil
+	}
+
+	polling := make(chan struct{})
+	go func() {
+		untappdLoop(ctx, feed, topics, client.User, store, links, budget, webhooks)
+		close(polling)
+	}()
+
+	if config.ThrowbackTime != "" && !config.ObserverMode {
+		go runDaily(config.Throwback, func(now time.Time) {
+			for _, line := range throwbackLines(store.Snapshot(), now) {
+				ircMessages <- line
+			}
+		})
+	}
+
+	if config.SummaryTime != "" && !config.ObserverMode {
+		go runDaily(config.Summary, func(now time.Time) {
+			for _, line := range buildDailySummary(store.Snapshot(), now) {
+				ircMessages <- line
+			}
+		})
+	}
+
+	handleConnection(ctx, bot, sasl)
+	if ctx.Err() != nil {
+		infof("Shutting down..")
+		// Let the poll loop finish the cycle it is in, which saves the cache
+		select {
+		case <-polling:
+		case <-time.After(shutdownTimeout):
+			warnf("Poll loop did not stop within %s.", shutdownTimeout)
+		}
+		bot.Sender.Send(&irc.Message{
+			Command: irc.QUIT,
+			Params:  []string{"Shutting down"},
+		})
+	}
+	infof("Exiting..")
 }
 
-func RegisterHandlers(bot *ircx.Bot) {
+// handleConnection handles irc messages until ctx is cancelled. A lost
+// connection is reconnected, giving up after config.MaxReconnects failed
+// attempts in a row.
+func handleConnection(ctx context.Context, bot *ircx.Bot, sasl *saslAuth) {
+	b := &backoff.Backoff{
+		Min:    10 * time.Second,
+		Max:    5 * time.Minute,
+		Factor: 2,
+		Jitter: true,
+	}
+
+	for {
+		disconnected := make(chan struct{})
+		go func() {
+			bot.HandleLoop()
+			close(disconnected)
+		}()
+
+		select {
+		case <-disconnected:
+		case <-ctx.Done():
+			return
+		}
+
+		for {
+			if int(b.Attempt()) >= config.MaxReconnects {
+				warnf("Unable to reconnect to %s, giving up.", config.Server)
+				return
+			}
+			d := b.Duration()
+			warnf("Lost connection to %s, reconnecting in %s.", config.Server, d)
+			if !sleepContext(ctx, d) {
+				return
+			}
+
+			// HandleLoop has closed the old channel
+			bot.Data = make(chan *irc.Message, 10)
+			if err := connect(bot, sasl); err != nil {
+				warnf("Unable to reconnect to %s: %s", config.Server, err)
+				continue
+			}
+			infof("Reconnected to %s", config.Server)
+			b.Reset()
+			break
+		}
+	}
+}
+
+func RegisterHandlers(bot *ircx.Bot, store *checkinStore, links *linkStore, settings *settingsStore, budget *apiBudget, lookups *lookupCommands, targeted chan targetedMessage) {
 	bot.HandleFunc(irc.RPL_WELCOME, RegisterConnect)
 	bot.HandleFunc(irc.PING, PingHandler)
 	bot.HandleFunc(irc.RPL_NAMREPLY, JoinedHandler)
+	bot.HandleFunc(irc.ERR_CHANOPRIVSNEEDED, NoPrivilegesHandler)
+	bot.HandleFunc(irc.ERROR, ErrorHandler)
+	bot.HandleFunc(irc.KILL, KillHandler)
+	bot.HandleFunc(irc.KICK, KickHandler)
+	bot.HandleFunc(irc.ERR_NICKNAMEINUSE, NickInUseHandler)
+	bot.HandleFunc(irc.NICK, NickChangeHandler)
+
+	// Keep track of who is in the channel
+	bot.HandleFunc(irc.RPL_NAMREPLY, links.NamesHandler)
+	bot.HandleFunc(irc.JOIN, links.JoinHandler)
+	bot.HandleFunc(irc.PART, links.PartHandler)
+	bot.HandleFunc(irc.KICK, links.KickHandler)
+	bot.HandleFunc(irc.QUIT, links.QuitHandler)
+	bot.HandleFunc(irc.NICK, links.NickHandler)
+
+	queries := &cacheCommands{store: store, private: targeted}
+	admin := &adminCommands{settings: settings, store: store, budget: budget}
+	commands := map[string]commandFunc{
+		"link":           links.LinkCommand,
+		"fullstats":      queries.FullStatsCommand,
+		"stats":          queries.StatsCommand,
+		"throwback":      queries.ThrowbackCommand,
+		"mostimproved":   queries.MostImprovedCommand,
+		"favbrewery":     queries.FavBreweryCommand,
+		"recent":         queries.RecentCommand,
+		"compare":        queries.CompareCommand,
+		"trending":       queries.TrendingCommand,
+		"outlier":        queries.OutlierCommand,
+		"beercount":      queries.BeerCountCommand,
+		"frequency":      queries.FrequencyCommand,
+		"recommend":      queries.RecommendCommand,
+		"stylebreakdown": queries.StyleBreakdownCommand,
+		"styles":         queries.StylesCommand,
+		"next":           queries.NextCommand,
+		"standing":       queries.StandingCommand,
+		"mosttoasted":    queries.MostToastedCommand,
+		"wordy":          queries.WordyCommand,
+		"leaderboard":    queries.LeaderboardCommand,
+		"beer":           lookups.BeerCommand,
+		"loglevel":       operatorOnly(admin.LogLevelCommand),
+		"set":            operatorOnly(admin.SetCommand),
+		"get":            operatorOnly(admin.GetCommand),
+		"track":          operatorOnly(admin.TrackCommand),
+		"untrack":        operatorOnly(admin.UntrackCommand),
+		"status":         operatorOnly(admin.StatusCommand),
+	}
+	bot.HandleFunc(irc.PRIVMSG, CommandHandler(commands, targeted))
 }
 
+// How long to wait after identifying to NickServ before joining, so that
+// channels which require it let the bot in.
+const nickServDelay = 3 * time.Second
+
 func RegisterConnect(s ircx.Sender, m *irc.Message) {
+	// The welcome is addressed to the nick the bot got
+	setNick(m.Param(0))
+
+	join := func() {
+		for _, channel := range config.Channels {
+			s.Send(&irc.Message{
+				Command: irc.JOIN,
+				Params:  []string{channel},
+			})
+		}
+	}
+
+	if config.NickServPassword == "" {
+		join()
+		return
+	}
+
+	// Never log the password
+	infof("Identifying to %s.", config.NickServName)
 	s.Send(&irc.Message{
-		Command: irc.JOIN,
-		Params:  []string{config.Channel},
+		Command: irc.PRIVMSG,
+		Params:  []string{config.NickServName, "IDENTIFY " + config.NickServPassword},
 	})
+	go func() {
+		time.Sleep(nickServDelay)
+		join()
+	}()
 }
 
 func PingHandler(s ircx.Sender, m *irc.Message) {
@@ -126,39 +1021,138 @@ func PingHandler(s ircx.Sender, m *irc.Message) {
 	})
 }
 
-func JoinedHandler(s ircx.Sender, m *irc.Message) {
-	log.Printf("Joined channel %s.", config.Channel)
+func JoinedHandler(s ircx.Sender, m *irc.Message) {
+	infof("Joined channel %s.", m.Param(2))
+}
+
+// NoPrivilegesHandler logs when the bot is not allowed to do something in
+// a channel, like setting the topic.
+func NoPrivilegesHandler(s ircx.Sender, m *irc.Message) {
+	warnf("Not allowed in %s: %s", m.Param(1), m.Trailing())
+}
+
+// targetedMessage is a line of text sent to a single channel or irc user,
+// like the reply to a command.
+type targetedMessage struct {
+	target string
+	text   string
+}
+
+// messageSink is where pushMessage delivers messages.
+type messageSink interface {
+	send(target string, text string)
+	topic(channel string, text string)
+}
+
+// ircSink sends messages to the irc server. Messages sent while the bot
+// is disconnected are lost.
+type ircSink struct {
+	sender   ircx.Sender
+	throttle <-chan time.Time
+}
+
+func newIrcSink(sender ircx.Sender, interval time.Duration) *ircSink {
+	// Avoid message flooding the irc server by waiting
+	// between messages
+	return &ircSink{sender: sender, throttle: time.Tick(interval)}
+}
+
+func (s *ircSink) send(target string, text string) {
+	<-s.throttle
+	s.sender.Send(&irc.Message{
+		Command: irc.PRIVMSG,
+		Params:  []string{target, text},
+	})
+}
+
+func (s *ircSink) topic(channel string, text string) {
+	<-s.throttle
+	s.sender.Send(&irc.Message{
+		Command: irc.TOPIC,
+		Params:  []string{channel, text},
+	})
+}
+
+// logSink writes messages to the log instead of sending them, for -dryrun.
+type logSink struct{}
+
+func (logSink) send(target string, text string) {
+	infow(stripFormatting(text), "target", target, "dry_run", true)
+}
+
+func (logSink) topic(channel string, text string) {
+	infow(stripFormatting(text), "topic", channel, "dry_run", true)
+}
+
+// Maximum length in bytes of the text of a message sent to irc. Lines are
+// at most 512 bytes, and the server adds the bot's prefix, the command and
+// the target when relaying them.
+const maxMessageBytes int = 400
+
+// splitMessage splits text into lines of at most n bytes, preferably at
+// spaces and never within a UTF-8 character.
+func splitMessage(text string, n int) []string {
+	lines := make([]string, 0, 1)
+	for len(text) > n {
+		cut := n
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		if space := strings.LastIndexByte(text[:cut], ' '); space > n/2 {
+			cut = space
+		}
+		lines = append(lines, text[:cut])
+		text = strings.TrimLeft(text[cut:], " ")
+	}
+	return append(lines, text)
 }
 
-func pushMessage(bot *ircx.Bot, cs chan string, channelName string) {
-	// Avoid message flooding the irc server by waiting
-	// two seconds between messages
-	throttle := time.Tick(2 * time.Second)
+// pushMessage sends the messages on cs to every channel, the targeted
+// messages to their target, and sets the topic of every channel to those
+// on topics.
+func pushMessage(ctx context.Context, sink messageSink, cs chan string, targeted chan targetedMessage, topics chan string, channels []string) {
 	for {
 		select {
 		case message := <-cs:
-			<-throttle
-			if bot.Sender != nil {
-				bot.Sender.Send(&irc.Message{
-					Command: irc.PRIVMSG,
-					Params:  []string{channelName, message},
-				})
+			for _, channel := range channels {
+				for _, line := range splitMessage(message, maxMessageBytes) {
+					sink.send(channel, line)
+				}
+			}
+		case topic := <-topics:
+			for _, channel := range channels {
+				sink.topic(channel, splitMessage(topic, maxMessageBytes)[0])
 			}
+		case message := <-targeted:
+			for _, line := range splitMessage(message.text, maxMessageBytes) {
+				sink.send(message.target, line)
+			}
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
+// getStats returns the lowest, highest and average rating of a beer in the
+// checkins, the number of checkins of it and the latest one. Unrated
+// checkins are counted, but left out of the ratings, which are 0 if none
+// are rated.
 func getStats(checkins []*untappd.Checkin, beer *untappd.Beer) (float64, float64, float64, int32, *untappd.Checkin) {
 	var min float64 = math.MaxFloat64
 	var max float64 = -math.MaxFloat64
 	var total float64 = 0.0
 	var count int32 = 0
+	var rated int32 = 0
 	var lastCheckin *untappd.Checkin = nil
 	for _, oldCheckin := range checkins {
 		if oldCheckin.Beer.ID == beer.ID {
 			if lastCheckin == nil || oldCheckin.ID > lastCheckin.ID {
 				lastCheckin = oldCheckin
 			}
+			count = count + 1
+			if oldCheckin.UserRating == 0 {
+				continue
+			}
 			if oldCheckin.UserRating < min {
 				min = oldCheckin.UserRating
 			}
@@ -166,52 +1160,405 @@ func getStats(checkins []*untappd.Checkin, beer *untappd.Beer) (float64, float64
 				max = oldCheckin.UserRating
 			}
 			total = total + oldCheckin.UserRating
-			count = count + 1
+			rated = rated + 1
+		}
+	}
+
+	if rated == 0 {
+		return 0, 0, 0, count, lastCheckin
+	}
+	return min, max, total / float64(rated), count, lastCheckin
+}
+
+// decayedAverage returns the average rating of a beer in the checkins,
+// where a rating counts half as much for every halfLife of age at now.
+// It returns false if none of the checkins of the beer are rated.
+func decayedAverage(checkins []*untappd.Checkin, beer *untappd.Beer, halfLife time.Duration, now time.Time) (float64, bool) {
+	var total, weights float64
+	for _, c := range checkins {
+		if c.Beer.ID != beer.ID || c.UserRating == 0 {
+			continue
+		}
+		age := now.Sub(c.Created)
+		if age < 0 {
+			age = 0
+		}
+		weight := math.Pow(0.5, float64(age)/float64(halfLife))
+		total += weight * c.UserRating
+		weights += weight
+	}
+	if weights == 0 {
+		return 0, false
+	}
+	return total / weights, true
+}
+
+// matchesVenue returns true if the venue is in the list, by name or ID.
+func matchesVenue(venue *untappd.Venue, venues []string) bool {
+	if venue == nil {
+		return false
+	}
+	for _, v := range venues {
+		if strings.EqualFold(v, venue.Name) || v == strconv.Itoa(venue.ID) {
+			return true
+		}
+	}
+	return false
+}
+
+// isVenueAnnounced applies the venue include and exclude lists.
+func isVenueAnnounced(venue *untappd.Venue) bool {
+	if len(config.IncludeVenues) > 0 && !matchesVenue(venue, config.IncludeVenues) {
+		return false
+	}
+	return !matchesVenue(venue, config.ExcludeVenues)
+}
+
+// isRatingAnnounced applies config.MinRating. Unrated checkins are always
+// announced.
+func isRatingAnnounced(rating float64) bool {
+	return rating == 0 || rating >= config.MinRating
+}
+
+// isNewRelease returns true if nobody in the group has checked in the beer
+// before, but someone has had another beer from the same brewery. Like
+// isFirstInGroup, it is always false while some user's history is capped.
+func isNewRelease(checkin *untappd.Checkin, userCheckins map[string][]*untappd.Checkin, capped map[string]bool) bool {
+	knownBrewery := false
+	for user, checkins := range userCheckins {
+		if capped[user] {
+			return false
+		}
+		for _, c := range checkins {
+			if c.ID == checkin.ID {
+				continue
+			}
+			if c.Beer.ID == checkin.Beer.ID {
+				return false
+			}
+			if c.Brewery.ID == checkin.Brewery.ID {
+				knownBrewery = true
+			}
+		}
+	}
+
+	return knownBrewery
+}
+
+// isFirstInGroup returns true if nobody in the group checked in the beer
+// before this checkin. That can't be known if only the latest checkins of
+// some user are cached, so it is then always false.
+func isFirstInGroup(checkin *untappd.Checkin, userCheckins map[string][]*untappd.Checkin, capped map[string]bool) bool {
+	for user, checkins := range userCheckins {
+		if capped[user] {
+			return false
+		}
+		for _, c := range checkins {
+			if c.ID != checkin.ID && c.Beer.ID == checkin.Beer.ID &&
+				byCheckinTime([]*untappd.Checkin{c, checkin}).Less(0, 1) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Number of rated checkins a user needs before their ratings are compared
+// to their average.
+const outlierMinRated int = 10
+
+// unusualRating describes the rating of the checkin if it is more than
+// config.OutlierSigma standard deviations from the average of the user's
+// other checkins, or returns an empty string.
+func unusualRating(checkin *untappd.Checkin, checkins []*untappd.Checkin) string {
+	if config.OutlierSigma <= 0 || checkin.UserRating == 0 {
+		return ""
+	}
+	others := make([]*untappd.Checkin, 0, len(checkins))
+	for _, c := range checkins {
+		if c.ID != checkin.ID {
+			others = append(others, c)
 		}
 	}
+	if countRated(others) < outlierMinRated {
+		return ""
+	}
 
-	return min, max, total / float64(count), count, lastCheckin
+	_, mean, stdev := getUserStats(others)
+	if stdev == 0 {
+		return ""
+	}
+	switch deviation := (checkin.UserRating - mean) / stdev; {
+	case deviation > config.OutlierSigma:
+		return fmt.Sprintf("  ⭐ unusually high for %s!", checkin.User.UserName)
+	case deviation < -config.OutlierSigma:
+		return fmt.Sprintf("  👎 unusually low for %s", checkin.User.UserName)
+	}
+	return ""
 }
 
-func sendCheckinToIrc(checkin *untappd.Checkin, cs chan string, userCheckins map[string][]*untappd.Checkin) {
+func sendCheckinToIrc(ctx context.Context, checkin *untappd.Checkin, cs chan string, userCheckins map[string][]*untappd.Checkin, capped map[string]bool, links *linkStore, showVenue bool) {
 	// Format the message and add it to the message channel
 	general, style, rating, venue := formatCheckin(checkin)
-	cs <- general
-	cs <- style
-	cs <- rating
-	if venue != "" {
-		cs <- venue
+	if matchesVenue(checkin.Venue, config.HighlightVenues) {
+		general = "📍 LOCAL: " + general
+	}
+	if enabled("ping_linked_users") {
+		if nick, ok := links.nickFor(checkin.User.UserName); ok {
+			general = fmt.Sprintf("%s: %s", nick, general)
+		}
+	}
+	if config.ShownFields["general"] {
+		sendContext(ctx, cs, general)
+	}
+	if enabled("show_new_releases") && isNewRelease(checkin, userCheckins, capped) {
+		sendContext(ctx, cs, fmt.Sprintf("  New from %s: %s", checkin.Brewery.Name, checkin.Beer.Name))
+	} else if enabled("show_first_in_channel") && isFirstInGroup(checkin, userCheckins, capped) {
+		sendContext(ctx, cs, "  🆕 First in the channel to try this!")
+	}
+	if config.ShownFields["style"] {
+		sendContext(ctx, cs, style)
+	}
+	if enabled("show_social") {
+		rating += formatSocial(checkin)
+	}
+	rating += unusualRating(checkin, userCheckins[checkin.User.UserName])
+	if config.ShownFields["rating"] {
+		sendContext(ctx, cs, rating)
+	}
+	if badges := formatBadges(checkin); badges != "" {
+		sendContext(ctx, cs, badges)
+	}
+	if enabled("show_revisits") {
+		if previous := previousCheckin(checkin, userCheckins[checkin.User.UserName]); previous != nil &&
+			previous.UserRating > 0 && checkin.UserRating > 0 && previous.UserRating != checkin.UserRating {
+			sendContext(ctx, cs, fmt.Sprintf("  %s revisited %s: was %0.1f, now %0.1f",
+				checkin.User.UserName, checkin.Beer.Name, previous.UserRating, checkin.UserRating))
+		}
+	}
+	if venue != "" && showVenue && config.ShownFields["venue"] {
+		if d, ok := nearbyDistance(checkin.Venue); ok {
+			venue += fmt.Sprintf("  (%0.1f km away)", d)
+		}
+		sendContext(ctx, cs, venue)
 	}
 
 	// Print ratings from the other users
+	if enabled("show_friend_ratings") {
+		ratings, others := limitFriendRatings(friendRatings(checkin, userCheckins), config.MaxPeerRatings)
+		for _, r := range ratings {
+			sendContext(ctx, cs, formatFriendRating(r))
+		}
+		if others > 0 {
+			sendContext(ctx, cs, fmt.Sprintf("    ... and %d others", others))
+		}
+	}
+}
+
+// previousCheckin returns the user's latest checkin of the same beer
+// before this one, or nil if this is the first time they have it.
+func previousCheckin(checkin *untappd.Checkin, checkins []*untappd.Checkin) *untappd.Checkin {
+	earlier := make([]*untappd.Checkin, 0, len(checkins))
+	for _, c := range checkins {
+		if c.ID != checkin.ID && byCheckinTime([]*untappd.Checkin{c, checkin}).Less(0, 1) {
+			earlier = append(earlier, c)
+		}
+	}
+
+	_, _, _, _, lastCheckin := getStats(earlier, checkin.Beer)
+	return lastCheckin
+}
+
+// friendRating is another user's rating of the beer being announced.
+type friendRating struct {
+	user        string
+	min         float64
+	max         float64
+	avg         float64
+	count       int32
+	lastCheckin *untappd.Checkin
+	// Average weighted by age, 0 unless config.HalfLife is set.
+	decayed float64
+}
+
+// friendRatings returns the ratings of the checkin's beer by the other
+// users who have had it, highest rated first.
+func friendRatings(checkin *untappd.Checkin, userCheckins map[string][]*untappd.Checkin) []friendRating {
+	ratings := make([]friendRating, 0)
 	for user, checkins := range userCheckins {
 		if user != checkin.User.UserName {
 			min, max, avg, count, lastCheckin := getStats(checkins, checkin.Beer)
 			if lastCheckin != nil {
-				localTime := time.Time.In(lastCheckin.Created, config.Location)
-				created := time.Time.Format(localTime, "02 Jan 2006 15:04")
-				stats := ""
-				if count > 1 {
-					stats = fmt.Sprintf("[%0.1f-%0.1f] %0.1f #%d",
-						min, max, avg, count)
+				r := friendRating{user, min, max, avg, count, lastCheckin, 0}
+				if config.HalfLife > 0 {
+					r.decayed, _ = decayedAverage(checkins, checkin.Beer, config.HalfLife, time.Now())
 				}
-				cs <- fmt.Sprintf("    %s rated this on %s: %0.1f  %s  %s", user, created,
-					lastCheckin.UserRating, lastCheckin.Comment, stats)
+				ratings = append(ratings, r)
+			}
+		}
+	}
+
+	sort.Slice(ratings, func(i, j int) bool {
+		if ratings[i].lastCheckin.UserRating != ratings[j].lastCheckin.UserRating {
+			return ratings[i].lastCheckin.UserRating > ratings[j].lastCheckin.UserRating
+		}
+		return ratings[i].user < ratings[j].user
+	})
+	return ratings
+}
+
+// limitFriendRatings keeps the n ratings by the users who had the beer most
+// recently, in their original order, and returns how many were left out.
+// An n of 0 keeps all of them.
+func limitFriendRatings(ratings []friendRating, n int) ([]friendRating, int) {
+	if n <= 0 || len(ratings) <= n {
+		return ratings, 0
+	}
+
+	recent := append([]friendRating(nil), ratings...)
+	sort.SliceStable(recent, func(i, j int) bool {
+		return recent[i].lastCheckin.Created.After(recent[j].lastCheckin.Created)
+	})
+	keep := make(map[string]bool, n)
+	for _, r := range recent[:n] {
+		keep[r.user] = true
+	}
+
+	limited := make([]friendRating, 0, n)
+	for _, r := range ratings {
+		if keep[r.user] {
+			limited = append(limited, r)
+		}
+	}
+	return limited, len(ratings) - n
+}
+
+func formatFriendRating(r friendRating) string {
+	localTime := time.Time.In(r.lastCheckin.Created, userLocation(r.user))
+	created := time.Time.Format(localTime, "02 Jan 2006 15:04")
+	stats := ""
+	if r.count > 1 {
+		stats = fmt.Sprintf("[%0.1f-%0.1f] %0.1f #%d",
+			r.min, r.max, r.avg, r.count)
+		if r.decayed > 0 {
+			stats += fmt.Sprintf(" recent %0.1f", r.decayed)
+		}
+	}
+	return fmt.Sprintf("    %s rated this on %s: %0.1f  %s  %s", r.user, created,
+		r.lastCheckin.UserRating, r.lastCheckin.Comment, stats)
+}
+
+func formatGroupSession(venue *untappd.Venue, users []string) string {
+	names := strings.Join(users, ", ")
+	if i := strings.LastIndex(names, ", "); i >= 0 {
+		names = names[:i] + ", and " + names[i+2:]
+	}
+	return fmt.Sprintf("🍻 Group session at %s: %s are there!", venue.Name, names)
+}
+
+// Minimum number of checkins in a row condensed into one announcement.
+const rapidMinCheckins int = 3
+
+// rapidRuns finds the checkins, sorted oldest first, which each user made
+// within window of their previous one, at least rapidMinCheckins in a row.
+// Every checkin of such a run maps to the whole run.
+func rapidRuns(checkins []*untappd.Checkin, window time.Duration) map[int][]*untappd.Checkin {
+	byUser := make(map[string][][]*untappd.Checkin)
+	for _, c := range checkins {
+		runs := byUser[c.User.UserName]
+		if n := len(runs); n > 0 {
+			last := runs[n-1][len(runs[n-1])-1]
+			if c.Created.Sub(last.Created) <= window {
+				runs[n-1] = append(runs[n-1], c)
+				continue
+			}
+		}
+		byUser[c.User.UserName] = append(runs, []*untappd.Checkin{c})
+	}
+
+	rapid := make(map[int][]*untappd.Checkin)
+	for _, runs := range byUser {
+		for _, run := range runs {
+			if len(run) < rapidMinCheckins {
+				continue
+			}
+			for _, c := range run {
+				rapid[c.ID] = run
 			}
 		}
 	}
+	return rapid
+}
+
+// sendRapidCheckinsToIrc announces a run of checkins by one user as a
+// single line listing the beers and ratings.
+func sendRapidCheckinsToIrc(ctx context.Context, run []*untappd.Checkin, cs chan string, links *linkStore) {
+	beers := make([]string, 0, len(run))
+	for _, c := range run {
+		beer := fmt.Sprintf("%s (%s)", c.Beer.Name, c.Brewery.Name)
+		if c.UserRating > 0 {
+			beer += fmt.Sprintf(" %.2f", c.UserRating)
+		}
+		beers = append(beers, beer)
+	}
+
+	user := run[0].User.UserName
+	line := fmt.Sprintf("%s had %d beers: %s", user, len(run), strings.Join(beers, ", "))
+	if enabled("ping_linked_users") {
+		if nick, ok := links.nickFor(user); ok {
+			line = fmt.Sprintf("%s: %s", nick, line)
+		}
+	}
+	sendContext(ctx, cs, line)
+}
+
+// formatTopic formats the channel topic showing the latest checkin.
+func formatTopic(checkin *untappd.Checkin) string {
+	topic := fmt.Sprintf("Last: %s - %s", checkin.User.UserName, checkin.Beer.Name)
+	if checkin.UserRating > 0 {
+		topic += fmt.Sprintf(" %0.1f", checkin.UserRating)
+	}
+	return topic
+}
+
+// summarizeCheckins formats a single line with the number of checkins per
+// user, used instead of announcing each of them.
+func summarizeCheckins(checkins []*untappd.Checkin) string {
+	counts := make(map[string]int)
+	users := make([]string, 0)
+	for _, c := range checkins {
+		if counts[c.User.UserName] == 0 {
+			users = append(users, c.User.UserName)
+		}
+		counts[c.User.UserName]++
+	}
+
+	parts := make([]string, 0, len(users))
+	for _, user := range users {
+		parts = append(parts, fmt.Sprintf("%s %d", user, counts[user]))
+	}
+	return fmt.Sprintf("Catching up on %d earlier checkins: %s.",
+		len(checkins), strings.Join(parts, ", "))
+}
+
+// recordAnnounced counts the checkin in the metrics, whether it is
+// announced on its own, in a run or in a batch summary.
+func recordAnnounced(checkin *untappd.Checkin) {
+	checkinsAnnounced.inc()
+	if checkin.UserRating > 0 {
+		ratingHistogram.observe(checkin.UserRating)
+	}
 }
 
 func logCheckin(checkin *untappd.Checkin) {
 	general, style, rating, venue := formatCheckin(checkin)
-	log.Printf("%s  %s  %s  %s", general, style, rating, venue)
+	infow(stripFormatting(fmt.Sprintf("%s  %s  %s  %s", general, style, rating, venue)),
+		"user", checkin.User.UserName, "checkin_id", checkin.ID, "beer_id", checkin.Beer.ID)
 }
 
 func calculatePollInterval(numUsers int) int {
-	// Untappd allows (only!) 100 api calls per hour
-	numApiCalls := 100
-	// Evenly distribute these calls for the different users
-	numCallsPerUser := float64(numApiCalls) / float64(numUsers)
+	// Evenly distribute the hourly api calls for the different users
+	numCallsPerUser := float64(ApiCallsPerHour) / float64(numUsers)
 	// And round up to make sure we stay within the rate limit
 	return int(math.Ceil(60.0 / numCallsPerUser))
 }
@@ -223,150 +1570,507 @@ func min(x, y int) int {
 	return y
 }
 
-// Get all checkins for a given user.
-func getAllCheckins(userName string, client *untappd.Client) []*untappd.Checkin {
-	log.Printf("Getting checkins for %s", userName)
+// checkinSource is where the checkins of the users are fetched from, which
+// is the untappd client's UserService.
+type checkinSource interface {
+	Checkins(username string) ([]*untappd.Checkin, *http.Response, error)
+	CheckinsMinMaxIDLimit(username string, minID int, maxID int, limit int) ([]*untappd.Checkin, *http.Response, error)
+}
+
+// getAllCheckins fetches the latest checkins of a user, at most maxCheckins
+// of them and only those newer than minId. It also returns whether it
+// stopped because of maxCheckins.
+func getAllCheckins(ctx context.Context, userName string, minId int, maxCheckins int, source checkinSource, budget *apiBudget) ([]*untappd.Checkin, bool) {
+	infow("Getting checkins", "user", userName, "min_id", minId)
 
-	nCheckins := 50
 	maxId := math.MaxInt32
 	allCheckins := make([]*untappd.Checkin, 0)
 
-	b := &backoff.Backoff{
-		Min:    60 * time.Second,
-		Max:    30 * time.Minute,
-		Factor: 2,
-		Jitter: true,
-	}
+	b := newBackoff()
+	var waited time.Duration
 
 	for {
-		if len(allCheckins) >= CheckinApiLimit {
-			log.Printf("Api limit reached for %s.", userName)
-			return allCheckins
+		if len(allCheckins) >= maxCheckins {
+			infow("Fetched the latest checkins", "user", userName, "count", maxCheckins)
+			return allCheckins, true
 		}
 
-		// The untappd api only allows you to get the lastest 300 checkins
-		// for other users (for non-obvious reasons).
-		limit := min(CheckinApiLimit-len(allCheckins), nCheckins)
-		log.Printf("Getting %d checkins %d through %d. Number of checkins: %d", limit, 0, maxId, len(allCheckins))
-		checkins, _, err := client.User.CheckinsMinMaxIDLimit(userName, 0, maxId, limit)
+		// Large user lists can use up the budget while starting up
+		if remaining, untilReset := budget.remaining(time.Now()); remaining == 0 {
+			warnw("Api budget used up while getting checkins, waiting",
+				"user", userName, "wait", untilReset)
+			if !sleepContext(ctx, untilReset) {
+				return allCheckins, false
+			}
+		}
+
+		limit := min(maxCheckins-len(allCheckins), checkinsPageSize)
+		debugw("Getting checkins", "user", userName, "limit", limit,
+			"min_id", minId, "max_id", maxId, "count", len(allCheckins))
+		budget.use(time.Now())
+		checkins, resp, err := source.CheckinsMinMaxIDLimit(userName, minId, maxId, limit)
+		budget.report(resp, time.Now())
 		if err != nil {
-			d := b.Duration()
-			log.Printf("%s, retrying in %s", err, d)
-			time.Sleep(d)
+			apiErrors.inc()
+			class := classifyError(err)
+			d, retry := retryDelay(class, b, budget)
+			if !retry {
+				warnw("Giving up getting checkins", "user", userName, "class", class, "error", err)
+				return allCheckins, false
+			}
+			waited += d
+			warnw("Retrying getting checkins", "user", userName, "class", class, "error", err,
+				"wait", d, "attempt", b.Attempt(), "waited", waited)
+			apiRetries.inc()
+			if !sleepContext(ctx, d) {
+				return allCheckins, false
+			}
 			continue
 		}
 
 		//connected
 		b.Reset()
 
-		log.Printf("Got %d checkins (%s, %d)", len(checkins), userName, maxId)
+		debugw("Got checkins", "user", userName, "count", len(checkins), "max_id", maxId)
+		// A short page doesn't mean there are no more, only an empty one does
 		if len(checkins) == 0 {
-			return allCheckins
+			return allCheckins, false
 		}
 
 		allCheckins = append(allCheckins, checkins...)
-		maxId = checkins[len(checkins)-1].ID
+
+		// Continue below the oldest checkin on this page. Pages are newest
+		// first, but don't trust that and loop forever if they aren't.
+		next := checkins[len(checkins)-1].ID - 1
+		if next >= maxId {
+			warnw("Checkin pages are not getting older, stopping", "user", userName, "max_id", maxId)
+			return allCheckins, false
+		}
+		maxId = next
 	}
 }
 
-func getCheckins(userName string, client *untappd.Client) []*untappd.Checkin {
-	b := &backoff.Backoff{
-		Min:    60 * time.Second,
-		Max:    30 * time.Minute,
-		Factor: 2,
-		Jitter: true,
-	}
+// getCheckins fetches the latest checkins of a user, retrying with backoff
+// until it succeeds. Repeated failures are posted through outage.
+func getCheckins(ctx context.Context, userName string, source checkinSource, budget *apiBudget, outage *outageNotice) []*untappd.Checkin {
+	b := newBackoff()
+	var waited time.Duration
 
 	for {
-		checkins, _, err := client.User.Checkins(userName)
+		budget.use(time.Now())
+		checkins, resp, err := source.Checkins(userName)
+		budget.report(resp, time.Now())
 		if err != nil {
-			d := b.Duration()
-			log.Printf("%s, retrying in %s", err, d)
-			time.Sleep(d)
+			apiErrors.inc()
+			class := classifyError(err)
+			if class == serverError {
+				outage.failed(ctx)
+			}
+			d, retry := retryDelay(class, b, budget)
+			if !retry {
+				warnw("Skipping user", "user", userName, "class", class, "error", err)
+				return nil
+			}
+			waited += d
+			warnw("Retrying getting checkins", "user", userName, "class", class, "error", err,
+				"wait", d, "attempt", b.Attempt(), "waited", waited)
+			apiRetries.inc()
+			if !sleepContext(ctx, d) {
+				return nil
+			}
 			continue
 		} else {
+			outage.succeeded(ctx)
 			return checkins
 		}
 	}
 }
 
+// formatCombinedStats formats the number of checkins and average rating of
+// every user on one line, which pushMessage splits if it is too long.
+// Users of whom only the latest checkins were fetched are marked with *.
+func formatCombinedStats(userCheckins map[string][]*untappd.Checkin, capped map[string]bool) string {
+	users := make([]string, 0, len(userCheckins))
+	for user := range userCheckins {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+
+	parts := make([]string, 0, len(users))
+	anyCapped := false
+	for _, user := range users {
+		count, avg, _ := getUserStats(userCheckins[user])
+		mark := ""
+		if capped[user] {
+			mark = "*"
+			anyCapped = true
+		}
+		parts = append(parts, fmt.Sprintf("%s %d%s (%0.2f)", user, count, mark, avg))
+	}
+
+	message := "untappd stats: " + strings.Join(parts, ", ") + "."
+	if anyCapped {
+		message += " * Only the latest checkins are counted."
+	}
+	return message
+}
+
+func formatUserStats(user string, checkins []*untappd.Checkin) string {
+	count, avg, stdev := getUserStats(checkins)
+	if count == 0 {
+		return fmt.Sprintf("untappd stats for %s: no checkins yet.", user)
+	}
+	if rated := countRated(checkins); rated < count {
+		return fmt.Sprintf("untappd stats for %s: %d checkins (%d rated) with %0.2f average rating [stdev: %0.2f].",
+			user, count, rated, avg, stdev)
+	}
+	return fmt.Sprintf("untappd stats for %s: %d checkins with %0.2f average rating [stdev: %0.2f].",
+		user, count, avg, stdev)
+}
+
+// getUserStats returns the number of checkins, and the mean and standard
+// deviation of their ratings. Unrated checkins are counted, but left out
+// of the ratings, which are 0 if none are rated.
 func getUserStats(checkins []*untappd.Checkin) (int, float64, float64) {
 	var mean, stdev float64
 	var count int = len(checkins)
+	rated := countRated(checkins)
+	if rated == 0 {
+		return count, 0, 0
+	}
 
 	sum := 0.0
 	for _, checkin := range checkins {
 		sum = sum + checkin.UserRating
 	}
-	mean = sum / float64(count)
+	mean = sum / float64(rated)
 
 	for _, checkin := range checkins {
-		stdev += math.Pow(checkin.UserRating-mean, 2)
+		if checkin.UserRating > 0 {
+			stdev += math.Pow(checkin.UserRating-mean, 2)
+		}
 	}
 
-	stdev = math.Sqrt(stdev / float64(count))
+	stdev = math.Sqrt(stdev / float64(rated))
 	return count, mean, stdev
 }
 
+// countRated returns the number of checkins with a rating.
+func countRated(checkins []*untappd.Checkin) int {
+	rated := 0
+	for _, checkin := range checkins {
+		if checkin.UserRating > 0 {
+			rated++
+		}
+	}
+	return rated
+}
+
 // byCheckinTime implements sort.Interface for []*untappd.Checkin.
+// Checkins with the same time are ordered by ID.
 type byCheckinTime []*untappd.Checkin
 
-func (b byCheckinTime) Len() int               { return len(b) }
-func (b byCheckinTime) Less(i int, j int) bool { return b[i].Created.Before(b[j].Created) }
-func (b byCheckinTime) Swap(i int, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byCheckinTime) Len() int          { return len(b) }
+func (b byCheckinTime) Swap(i int, j int) { b[i], b[j] = b[j], b[i] }
+func (b byCheckinTime) Less(i int, j int) bool {
+	if b[i].Created.Equal(b[j].Created) {
+		return b[i].ID < b[j].ID
+	}
+	return b[i].Created.Before(b[j].Created)
+}
 
-func untappdLoop(ircMessages chan string) {
+func untappdLoop(ctx context.Context, ircMessages chan string, topics chan string, source checkinSource, store *checkinStore, links *linkStore, budget *apiBudget, webhooks chan *untappd.Checkin) {
 
-	log.Printf("Starting untappd event loop.")
-	client, err := untappd.NewClient(
-		config.ClientId,
-		config.ClientSecret,
-		nil,
-	)
+	infof("Starting untappd event loop.")
+	users := trackedUsers()
+	scheduler := newPollScheduler(len(users))
+	infof("Initial polling interval: %s", scheduler.interval)
+	if perHour := ApiCallsPerHour - budgetReserve; len(users) > perHour {
+		warnf("%d users is more than the %d that can be checked each hour, rotating through them.",
+			len(users), perHour)
+	}
 
-	if err != nil {
-		log.Fatal(err)
+	// Start from the checkins saved before the last restart, if any
+	saved := make(map[string][]*untappd.Checkin)
+	var savedCapped map[string]bool
+	if config.CacheFile != "" {
+		if loaded, loadedCapped, err := loadCache(config.CacheFile); err == nil {
+			saved, savedCapped = loaded, loadedCapped
+		} else if !os.IsNotExist(err) {
+			warnf("Unable to load cached checkins, fetching them again: %s", err)
+		}
 	}
 
-	pollInterval := calculatePollInterval(len(config.Users))
-	log.Printf("Polling interval: %d min", pollInterval)
+	// Fill the cache with checkins for each user
+	capped := make(map[string]bool)
+	for _, user := range users {
+		minId := 0
+		for _, c := range saved[user.Name] {
+			if c.ID > minId {
+				minId = c.ID
+			}
+		}
 
-	// Generate map of checkins for each user
-	userCheckins := make(map[string][]*untappd.Checkin)
-	for _, user := range config.Users {
-		userCheckins[user.Name] = getAllCheckins(user.Name, client)
+		checkins, limited := getAllCheckins(ctx, user.Name, minId, historyLimit(user.Name), source, budget)
+		if len(saved[user.Name]) > 0 {
+			infow("Got new checkins since the last restart", "user", user.Name, "count", len(checkins))
+			// Older cache files don't say, assume a full cache is capped
+			if savedCapped == nil {
+				limited = limited || len(saved[user.Name]) >= historyLimit(user.Name)
+			} else {
+				limited = limited || savedCapped[user.Name]
+			}
+			checkins = append(saved[user.Name], checkins...)
+		}
+		if user.Export != "" {
+			exported, err := readExport(user.Name, user.Export)
+			if err != nil {
+				warnw("Unable to import checkins", "user", user.Name, "error", err)
+			} else {
+				// The api has the latest version of any checkin in both
+				fetched := checkinIDs(checkins)
+				imported := 0
+				for _, c := range exported {
+					if _, ok := fetched[c.ID]; !ok {
+						checkins = append(checkins, c)
+						imported++
+					}
+				}
+				infow("Imported checkins", "user", user.Name, "count", imported, "file", user.Export)
+				limited = false
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		store.Set(user.Name, checkins)
+		capped[user.Name] = limited
 	}
 
 	// Generate some statistics for all users
-	message := fmt.Sprintf("Statistics for up to %d checkins (untappd api limit).",
-		CheckinApiLimit)
-	ircMessages <- message
-	for user, checkins := range userCheckins {
+	switch config.StartupStats {
+	case "each":
+		for user, checkins := range store.Snapshot() {
+			message := formatUserStats(user, checkins)
+			if capped[user] {
+				message += fmt.Sprintf(" Only the latest %d checkins are counted.",
+					historyLimit(user))
+			}
+			sendContext(ctx, ircMessages, message)
+			infof("%s", message)
+		}
+	case "combined":
+		message := formatCombinedStats(store.Snapshot(), capped)
+		sendContext(ctx, ircMessages, message)
+		infof("%s", message)
+	}
+
+	order := make([]string, 0, len(users))
+	for _, user := range users {
+		order = append(order, user.Name)
+	}
 
-		count, avg, stdev := getUserStats(checkins)
-		message := fmt.Sprintf("untappd stats for %s: %d checkins with %0.2f average rating [stdev: %0.2f].",
-			user, count, avg, stdev)
-		ircMessages <- message
-		log.Println(message)
+	// The cache only gives the total number of checkins of users whose
+	// whole history it holds
+	milestones := newMilestoneTracker(config.Milestones)
+	for user, checkins := range store.Snapshot() {
+		if !capped[user] {
+			milestones.update(user, len(checkins))
+		}
 	}
 
+	overtakes := make(overtakeTracker)
+	sessionsAnnounced := make(sessionTracker)
+	outage := newOutageNotice(config.UnreachableAfter, ircMessages)
+	inMaintenance := false
 	for {
-		log.Printf("Checking %d users.\n", len(config.Users))
-		for _, user := range config.Users {
-			checkins := getCheckins(user.Name, client)
+		if config.Maintenance != nil && config.Maintenance.contains(time.Now(), config.Location) {
+			end := config.Maintenance.end.next(time.Now(), config.Location)
+			if !inMaintenance {
+				inMaintenance = true
+				sendContext(ctx, ircMessages, fmt.Sprintf("Maintenance window, not checking untappd until %s.",
+					end.Format("15:04")))
+			}
+			lastPoll.polled(time.Now(), time.Until(end))
+			if !sleepContext(ctx, time.Until(end)) {
+				return
+			}
+			continue
+		}
+		if inMaintenance {
+			inMaintenance = false
+			sendContext(ctx, ircMessages, "Maintenance window over, checking untappd again.")
+		}
+
+		// Follow the users added and removed with !track and !untrack
+		order = syncUsers(order, trackedUsers())
+		for user := range store.Counts() {
+			if !containsString(order, user) {
+				store.Delete(user)
+			}
+		}
+
+		infof("Checking %d users.", len(order))
+		newCheckins := 0
+		announce := make([]*untappd.Checkin, 0)
+		passes := make([][2]string, 0)
+		reached := make(map[string]int)
+		deletions := make([]*untappd.Checkin, 0)
+		polled := 0
+		for _, user := range order {
+			// Shutting down, finish the cycle with what has been fetched
+			if ctx.Err() != nil {
+				break
+			}
+			if remaining, _ := budget.remaining(time.Now()); remaining <= budgetReserve {
+				warnf("Api budget nearly used up, skipping %s until next cycle.",
+					strings.Join(order[polled:], ", "))
+				break
+			}
+			polled++
+
+			if !store.HasUser(user) {
+				// Added with !track, get their history without announcing it
+				checkins, limited := getAllCheckins(ctx, user, 0, historyLimit(user), source, budget)
+				store.Set(user, checkins)
+				capped[user] = limited
+				if !limited {
+					milestones.update(user, len(checkins))
+				}
+				continue
+			}
+
+			checkins := getCheckins(ctx, user, source, budget, outage)
+
+			cached, _ := store.Get(user)
+			for _, c := range deletedCheckins(checkins, cached) {
+				infow(fmt.Sprintf("%s deleted a checkin of %s", user, c.Beer.Name),
+					"user", user, "checkin_id", c.ID)
+				store.Remove(user, c.ID)
+				deletions = append(deletions, c)
+			}
 
-			// Sort to get oldest checkin first
-			sort.Sort(byCheckinTime(checkins))
 			for _, c := range checkins {
-				// Print all new checkins since last poll
-				if isCheckinNew(c, userCheckins[user.Name]) {
-					userCheckins[user.Name] = append(userCheckins[user.Name], c)
-					sendCheckinToIrc(c, ircMessages, userCheckins)
+				// Collect all new checkins since last poll
+				if !store.Has(user, c.ID) {
+					for _, other := range overtaken(user, store.Counts(), capped) {
+						passes = append(passes, [2]string{user, other})
+					}
+					store.Append(user, c)
+					newCheckins++
 					logCheckin(c)
+					if isVenueAnnounced(c.Venue) && isRatingAnnounced(c.UserRating) {
+						announce = append(announce, c)
+					}
+				}
+			}
+
+			count := 0
+			if len(checkins) > 0 && checkins[0].User != nil {
+				count = checkins[0].User.Stats.TotalCheckins
+			}
+			if count == 0 && !capped[user] {
+				count = store.Counts()[user]
+			}
+			if count > 0 {
+				if m, ok := milestones.update(user, count); ok {
+					reached[user] = m
+				}
+			}
+		}
+
+		order = rotateUsers(order, polled)
+
+		// Sort to get oldest checkin first
+		sort.Sort(byCheckinTime(announce))
+		// Only the irc announcements are batched, everything else sees each
+		// checkin
+		for _, c := range announce {
+			recordAnnounced(c)
+			if webhooks != nil {
+				queueWebhook(webhooks, c)
+			}
+		}
+		if config.BatchThreshold > 0 && len(announce) > config.BatchThreshold {
+			older := announce[:len(announce)-config.BatchAnnounceCount]
+			sendContext(ctx, ircMessages, summarizeCheckins(older))
+			announce = announce[len(older):]
+		}
+
+		sessions := make(map[int][]*untappd.Checkin)
+		if enabled("show_group_sessions") {
+			sessions = groupSessions(announce, store.Snapshot())
+			for venue, session := range sessions {
+				if !sessionsAnnounced.allow(venue, len(sessionUsers(session)), time.Now()) {
+					delete(sessions, venue)
+				}
+			}
+		}
+		rapid := make(map[int][]*untappd.Checkin)
+		if config.Rapid > 0 {
+			rapid = rapidRuns(announce, config.Rapid)
+		}
+		announced := make(map[int]bool)
+		for _, c := range announce {
+			if run, ok := rapid[c.ID]; ok {
+				if run[0] == c {
+					sendRapidCheckinsToIrc(ctx, run, ircMessages, links)
+				}
+				continue
+			}
+			inSession := false
+			if c.Venue != nil {
+				for _, other := range sessions[c.Venue.ID] {
+					inSession = inSession || other.ID == c.ID
+				}
+			}
+			if inSession && !announced[c.Venue.ID] {
+				announced[c.Venue.ID] = true
+				sendContext(ctx, ircMessages, formatGroupSession(c.Venue, sessionUsers(sessions[c.Venue.ID])))
+			}
+			sendCheckinToIrc(ctx, c, ircMessages, store.Snapshot(), capped, links, !inSession)
+		}
+		if enabled("announce_deletions") {
+			for _, c := range deletions {
+				sendContext(ctx, ircMessages, fmt.Sprintf("%s deleted their checkin of %s (%s).",
+					c.User.UserName, c.Beer.Name, c.Brewery.Name))
+			}
+		}
+		if enabled("show_overtakes") {
+			for _, pass := range passes {
+				if overtakes.allow(pass[0], pass[1], time.Now()) {
+					sendContext(ctx, ircMessages, fmt.Sprintf("%s just passed %s in total checkins!", pass[0], pass[1]))
 				}
 			}
-			sort.Sort(byCheckinTime(userCheckins[user.Name]))
 		}
-		time.Sleep(time.Duration(pollInterval) * time.Minute)
+		if enabled("show_milestones") {
+			for user, m := range reached {
+				sendContext(ctx, ircMessages, fmt.Sprintf("🎉 %s just hit %d checkins!", user, m))
+			}
+		}
+		if topics != nil && len(announce) > 0 {
+			sendContext(ctx, topics, formatTopic(announce[len(announce)-1]))
+		}
+
+		if config.CacheFile != "" {
+			if err := saveCache(store.Snapshot(), capped, config.CacheFile); err != nil {
+				warnf("Unable to save cached checkins: %s", err)
+			}
+		}
+
+		remaining, untilReset := budget.remaining(time.Now())
+		sleep := scheduler.next(newCheckins, len(order), remaining, untilReset)
+		// Untappd may know of calls we don't, like those made before a restart
+		if safe := budget.rateLimit().safeSleep(len(order), time.Now()); safe > sleep {
+			debugf("Untappd reports %d api calls left, slowing down.", budget.rateLimit().remaining)
+			sleep = safe
+		}
+		pollInterval.set(sleep.Seconds())
+		lastPoll.polled(time.Now(), sleep)
+		debugw("Sleeping until the next poll", "new_checkins", newCheckins,
+			"api_calls_left", remaining, "sleep", sleep)
+		if !sleepContext(ctx, sleep) {
+			return
+		}
 	}
 }
@@ -0,0 +1,1148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mdlayher/untappd"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// testCheckin returns a checkin of the beer by user, made at created.
+func testCheckin(id int, user string, beerID int, rating float64, created time.Time) *untappd.Checkin {
+	return &untappd.Checkin{
+		ID:         id,
+		Created:    created,
+		UserRating: rating,
+		User:       &untappd.User{UserName: user},
+		Beer:       &untappd.Beer{ID: beerID, Name: "Beer " + strconv.Itoa(beerID)},
+		Brewery:    &untappd.Brewery{ID: beerID, Name: "Brewery " + strconv.Itoa(beerID)},
+	}
+}
+
+// testCheckins returns n checkins by user with IDs from first up, an hour
+// apart, each of a different beer.
+func testCheckins(user string, first int, n int) []*untappd.Checkin {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	checkins := make([]*untappd.Checkin, 0, n)
+	for id := first; id < first+n; id++ {
+		checkins = append(checkins, testCheckin(id, user, id, 3.5, start.Add(time.Duration(id)*time.Hour)))
+	}
+	return checkins
+}
+
+// fakeSource is a checkinSource serving canned checkins. Each call fails
+// with the next of errs first, if there are any left.
+type fakeSource struct {
+	mu       sync.Mutex
+	checkins map[string][]*untappd.Checkin
+	// Checkins made after the cache is filled, which show up from the
+	// first call to Checkins on.
+	pending map[string][]*untappd.Checkin
+	// IDs of checkins deleted after the cache is filled.
+	deleted map[string][]int
+	errs    []error
+	// Most checkins returned per page, untappd may return fewer than
+	// asked for.
+	page  int
+	calls int
+	// Users whose latest checkins were asked for, in order.
+	polled []string
+	// Headers of every response, nil for no response at all.
+	header http.Header
+	// Called with the user on every call to Checkins.
+	onPoll func(user string)
+}
+
+func newFakeSource(checkins ...*untappd.Checkin) *fakeSource {
+	f := &fakeSource{
+		checkins: make(map[string][]*untappd.Checkin),
+		pending:  make(map[string][]*untappd.Checkin),
+		deleted:  make(map[string][]int),
+		page:     checkinsPageSize,
+	}
+	for _, c := range checkins {
+		f.checkins[c.User.UserName] = append(f.checkins[c.User.UserName], c)
+	}
+	return f
+}
+
+// fail returns the next scripted error, if any.
+func (f *fakeSource) fail() error {
+	f.calls++
+	if len(f.errs) == 0 {
+		return nil
+	}
+	err := f.errs[0]
+	f.errs = f.errs[1:]
+	return err
+}
+
+// response returns the response sent with the checkins.
+func (f *fakeSource) response() *http.Response {
+	if f.header == nil {
+		return nil
+	}
+	return &http.Response{Header: f.header}
+}
+
+// newestFirst returns the user's checkins with an ID in (minID, maxID],
+// newest first, at most limit of them.
+func (f *fakeSource) newestFirst(username string, minID int, maxID int, limit int) []*untappd.Checkin {
+	checkins := make([]*untappd.Checkin, 0)
+	for _, c := range f.checkins[username] {
+		if c.ID > minID && c.ID <= maxID {
+			checkins = append(checkins, c)
+		}
+	}
+	sort.Sort(sort.Reverse(byCheckinTime(checkins)))
+	if len(checkins) > limit {
+		checkins = checkins[:limit]
+	}
+	return checkins
+}
+
+func (f *fakeSource) Checkins(username string) ([]*untappd.Checkin, *http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.polled = append(f.polled, username)
+	if f.onPoll != nil {
+		f.onPoll(username)
+	}
+	if err := f.fail(); err != nil {
+		return nil, nil, err
+	}
+	f.checkins[username] = append(f.checkins[username], f.pending[username]...)
+	delete(f.pending, username)
+	kept := make([]*untappd.Checkin, 0, len(f.checkins[username]))
+	for _, c := range f.checkins[username] {
+		if !containsInt(f.deleted[username], c.ID) {
+			kept = append(kept, c)
+		}
+	}
+	f.checkins[username] = kept
+	return f.newestFirst(username, 0, math.MaxInt32, 25), f.response(), nil
+}
+
+func (f *fakeSource) CheckinsMinMaxIDLimit(username string, minID int, maxID int, limit int) ([]*untappd.Checkin, *http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.fail(); err != nil {
+		return nil, nil, err
+	}
+	return f.newestFirst(username, minID, maxID, min(limit, f.page)), f.response(), nil
+}
+
+func containsInt(ids []int, id int) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeSource) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+// fastRetries makes the retries of failed api calls wait a millisecond.
+func fastRetries(t *testing.T) {
+	oldMin, oldMax := retryMin, retryMax
+	retryMin, retryMax = time.Millisecond, time.Millisecond
+	t.Cleanup(func() { retryMin, retryMax = oldMin, oldMax })
+}
+
+func ids(checkins []*untappd.Checkin) []int {
+	ids := make([]int, 0, len(checkins))
+	for _, c := range checkins {
+		ids = append(ids, c.ID)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func TestGetAllCheckinsPages(t *testing.T) {
+	source := newFakeSource(testCheckins("alice", 1, 120)...)
+	checkins, limited := getAllCheckins(context.Background(), "alice", 0, CheckinApiLimit, source, newApiBudget(ApiCallsPerHour))
+	if len(checkins) != 120 || limited {
+		t.Fatalf("got %d checkins, limited %v, want 120 and false", len(checkins), limited)
+	}
+	// Three full pages and an empty one
+	if source.callCount() != 4 {
+		t.Errorf("made %d calls, want 4", source.callCount())
+	}
+	for i, id := range ids(checkins) {
+		if id != i+1 {
+			t.Fatalf("got checkin %d at %d, want every checkin once", id, i)
+		}
+	}
+}
+
+func TestGetAllCheckinsShortPages(t *testing.T) {
+	source := newFakeSource(testCheckins("alice", 1, 70)...)
+	source.page = 20
+	checkins, _ := getAllCheckins(context.Background(), "alice", 0, CheckinApiLimit, source, newApiBudget(ApiCallsPerHour))
+	if len(checkins) != 70 {
+		t.Errorf("got %d checkins, want 70", len(checkins))
+	}
+}
+
+func TestGetAllCheckinsLimit(t *testing.T) {
+	source := newFakeSource(testCheckins("alice", 1, 120)...)
+	checkins, limited := getAllCheckins(context.Background(), "alice", 0, 60, source, newApiBudget(ApiCallsPerHour))
+	if len(checkins) != 60 || !limited {
+		t.Fatalf("got %d checkins, limited %v, want 60 and true", len(checkins), limited)
+	}
+	// The latest ones
+	if got := ids(checkins); got[0] != 61 || got[59] != 120 {
+		t.Errorf("got checkins %d to %d, want 61 to 120", got[0], got[59])
+	}
+}
+
+func TestGetAllCheckinsMinId(t *testing.T) {
+	source := newFakeSource(testCheckins("alice", 1, 120)...)
+	checkins, limited := getAllCheckins(context.Background(), "alice", 100, CheckinApiLimit, source, newApiBudget(ApiCallsPerHour))
+	if len(checkins) != 20 || limited {
+		t.Fatalf("got %d checkins, limited %v, want 20 and false", len(checkins), limited)
+	}
+	for _, id := range ids(checkins) {
+		if id <= 100 {
+			t.Errorf("got checkin %d, want only those after 100", id)
+		}
+	}
+}
+
+func TestGetAllCheckinsRetry(t *testing.T) {
+	fastRetries(t)
+	source := newFakeSource(testCheckins("alice", 1, 60)...)
+	source.errs = []error{errors.New("connection reset"), &untappd.Error{Code: http.StatusBadGateway}}
+	checkins, _ := getAllCheckins(context.Background(), "alice", 0, CheckinApiLimit, source, newApiBudget(ApiCallsPerHour))
+	if len(checkins) != 60 {
+		t.Errorf("got %d checkins after retrying, want 60", len(checkins))
+	}
+}
+
+func TestGetAllCheckinsClientError(t *testing.T) {
+	fastRetries(t)
+	source := newFakeSource(testCheckins("alice", 1, 60)...)
+	source.errs = []error{&untappd.Error{Code: http.StatusNotFound}}
+	checkins, _ := getAllCheckins(context.Background(), "alice", 0, CheckinApiLimit, source, newApiBudget(ApiCallsPerHour))
+	if len(checkins) != 0 || source.callCount() != 1 {
+		t.Errorf("got %d checkins in %d calls, want to give up after 1", len(checkins), source.callCount())
+	}
+}
+
+func TestGetCheckinsRetry(t *testing.T) {
+	fastRetries(t)
+	source := newFakeSource(testCheckins("alice", 1, 30)...)
+	source.errs = []error{errors.New("timeout"), errors.New("timeout"), errors.New("timeout")}
+	cs := make(chan string, 10)
+	outage := newOutageNotice(3, cs)
+
+	checkins := getCheckins(context.Background(), "alice", source, newApiBudget(ApiCallsPerHour), outage)
+	if len(checkins) != 25 || source.callCount() != 4 {
+		t.Fatalf("got %d checkins in %d calls, want 25 in 4", len(checkins), source.callCount())
+	}
+	close(cs)
+	messages := make([]string, 0)
+	for m := range cs {
+		messages = append(messages, m)
+	}
+	if len(messages) != 2 || !strings.Contains(messages[0], "unreachable") ||
+		!strings.Contains(messages[1], "recovered") {
+		t.Errorf("got %q, want one unreachable and one recovered notice", messages)
+	}
+}
+
+func TestGetCheckinsCancelled(t *testing.T) {
+	source := newFakeSource(testCheckins("alice", 1, 30)...)
+	source.errs = []error{errors.New("timeout")}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	outage := newOutageNotice(5, make(chan string, 1))
+	if checkins := getCheckins(ctx, "alice", source, newApiBudget(ApiCallsPerHour), outage); checkins != nil {
+		t.Errorf("got %d checkins, want to stop waiting to retry", len(checkins))
+	}
+}
+
+func TestUntappdLoopAnnouncesNewCheckins(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config = Config{
+		Users:             []User{{Name: "alice"}, {Name: "bob"}},
+		Location:          time.UTC,
+		InitialFetchCount: CheckinApiLimit,
+		StartupStats:      "off",
+		UnreachableAfter:  5,
+		MaxCommentLength:  200,
+		ShownFields:       map[string]bool{"general": true},
+	}
+
+	source := newFakeSource(append(testCheckins("alice", 1, 3), testCheckins("bob", 10, 2)...)...)
+	source.pending["alice"] = testCheckins("alice", 20, 1)
+	store := newCheckinStore()
+	cs := make(chan string, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		untappdLoop(ctx, cs, nil, source, store, newLinkStore(&settingsStore{}), newApiBudget(ApiCallsPerHour), nil)
+		close(done)
+	}()
+
+	select {
+	case message := <-cs:
+		if !strings.Contains(message, "untappd alert for alice") || !strings.Contains(message, "Beer 20") {
+			t.Errorf("got %q, want the new checkin of alice", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no checkin announced")
+	}
+	cancel()
+	<-done
+
+	close(cs)
+	for message := range cs {
+		if strings.Contains(message, "untappd alert") {
+			t.Errorf("got %q, want only the new checkin announced", message)
+		}
+	}
+	counts := store.Counts()
+	if counts["alice"] != 4 || counts["bob"] != 2 {
+		t.Errorf("cached %v, want alice 4 and bob 2", counts)
+	}
+}
+
+func TestIsVenueAnnounced(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	bar := &untappd.Venue{ID: 42, Name: "The Local"}
+	home := &untappd.Venue{ID: 7, Name: "Alice's Home"}
+
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		venue   *untappd.Venue
+		want    bool
+	}{
+		{"no lists", nil, nil, bar, true},
+		{"no lists, no venue", nil, nil, nil, true},
+		{"included by name", []string{"the local"}, nil, bar, true},
+		{"included by id", []string{"42"}, nil, bar, true},
+		{"not included", []string{"The Local"}, nil, home, false},
+		{"not included, no venue", []string{"The Local"}, nil, nil, false},
+		{"excluded by name", nil, []string{"Alice's Home"}, home, false},
+		{"excluded by id", nil, []string{"7"}, home, false},
+		{"not excluded", nil, []string{"7"}, bar, true},
+		{"not excluded, no venue", nil, []string{"7"}, nil, true},
+		{"included and excluded", []string{"42"}, []string{"The Local"}, bar, false},
+	}
+	for _, tt := range tests {
+		config = Config{IncludeVenues: tt.include, ExcludeVenues: tt.exclude}
+		if got := isVenueAnnounced(tt.venue); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFriendRatings(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config = Config{Location: time.UTC}
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	checkin := testCheckin(100, "alice", 1, 4, start.Add(100*time.Hour))
+	userCheckins := map[string][]*untappd.Checkin{
+		"alice": {checkin},
+		"bob":   {testCheckin(1, "bob", 1, 3, start.Add(1*time.Hour))},
+		"carol": {testCheckin(2, "carol", 1, 4.5, start.Add(2*time.Hour))},
+		"dave":  {testCheckin(3, "dave", 1, 2, start.Add(3*time.Hour))},
+		"erin":  {testCheckin(4, "erin", 2, 5, start.Add(4*time.Hour))},
+	}
+
+	ratings := friendRatings(checkin, userCheckins)
+	users := make([]string, 0)
+	for _, r := range ratings {
+		users = append(users, r.user)
+	}
+	if got := strings.Join(users, ","); got != "carol,bob,dave" {
+		t.Fatalf("got %s, want the others who had it, highest rated first", got)
+	}
+
+	// The two who had it most recently, still highest rated first
+	limited, others := limitFriendRatings(ratings, 2)
+	if len(limited) != 2 || limited[0].user != "carol" || limited[1].user != "dave" || others != 1 {
+		t.Errorf("got %+v and %d others, want carol and dave and 1 other", limited, others)
+	}
+	if all, others := limitFriendRatings(ratings, 0); len(all) != 3 || others != 0 {
+		t.Errorf("got %d ratings and %d others, want all 3 without a limit", len(all), others)
+	}
+}
+
+// announced returns the lines sendCheckinToIrc posts for the checkin.
+func announced(checkin *untappd.Checkin, userCheckins map[string][]*untappd.Checkin) []string {
+	cs := make(chan string, 100)
+	sendCheckinToIrc(context.Background(), checkin, cs, userCheckins, nil, newLinkStore(&settingsStore{}), true)
+	close(cs)
+	lines := make([]string, 0)
+	for line := range cs {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestSendCheckinFriendRatings(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	checkin := testCheckin(100, "alice", 1, 4, start.Add(100*time.Hour))
+	userCheckins := map[string][]*untappd.Checkin{"alice": {checkin}}
+	for i, user := range []string{"bob", "carol", "dave", "erin"} {
+		userCheckins[user] = []*untappd.Checkin{testCheckin(i+1, user, 1, 3, start.Add(time.Duration(i)*time.Hour))}
+	}
+
+	count := func(lines []string, text string) int {
+		n := 0
+		for _, line := range lines {
+			if strings.Contains(line, text) {
+				n++
+			}
+		}
+		return n
+	}
+
+	config = Config{Location: time.UTC, ShowFriendRatings: true}
+	if n := count(announced(checkin, userCheckins), "rated this"); n != 4 {
+		t.Errorf("got %d friend ratings, want 4", n)
+	}
+
+	config.MaxPeerRatings = 2
+	lines := announced(checkin, userCheckins)
+	if n := count(lines, "rated this"); n != 2 || count(lines, "and 2 others") != 1 {
+		t.Errorf("got %q, want 2 friend ratings and 2 others", lines)
+	}
+
+	config.ShowFriendRatings = false
+	if n := count(announced(checkin, userCheckins), "rated this"); n != 0 {
+		t.Errorf("got %d friend ratings, want none", n)
+	}
+}
+
+func TestRevisits(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config = Config{Location: time.UTC, ShowRevisits: true}
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	first := testCheckin(1, "alice", 1, 3.5, start)
+	other := testCheckin(2, "alice", 2, 2, start.Add(time.Hour))
+	again := testCheckin(3, "alice", 1, 4, start.Add(2*time.Hour))
+	checkins := []*untappd.Checkin{first, other, again}
+
+	if previous := previousCheckin(again, checkins); previous != first {
+		t.Errorf("got %v, want the first checkin of the beer", previous)
+	}
+	if previous := previousCheckin(first, checkins); previous != nil {
+		t.Errorf("got %v for a first time checkin, want none", previous)
+	}
+
+	revisits := func(c *untappd.Checkin) []string {
+		lines := make([]string, 0)
+		for _, line := range announced(c, map[string][]*untappd.Checkin{"alice": checkins}) {
+			if strings.Contains(line, "revisited") {
+				lines = append(lines, line)
+			}
+		}
+		return lines
+	}
+	if got := revisits(again); len(got) != 1 || !strings.Contains(got[0], "was 3.5, now 4.0") {
+		t.Errorf("got %q, want the revisit announced", got)
+	}
+	if got := revisits(first); len(got) != 0 {
+		t.Errorf("got %q for a first time checkin, want none", got)
+	}
+
+	// The same rating as before is no news
+	same := testCheckin(4, "alice", 2, 2, start.Add(3*time.Hour))
+	checkins = append(checkins, same)
+	if got := revisits(same); len(got) != 0 {
+		t.Errorf("got %q for an unchanged rating, want none", got)
+	}
+
+	config.ShowRevisits = false
+	if got := revisits(again); len(got) != 0 {
+		t.Errorf("got %q with show_revisits off, want none", got)
+	}
+}
+
+func TestByCheckinTimeTies(t *testing.T) {
+	at := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 20; i++ {
+		checkins := []*untappd.Checkin{
+			testCheckin(5, "alice", 1, 4, at),
+			testCheckin(3, "bob", 1, 4, at),
+			testCheckin(9, "alice", 1, 4, at.Add(-time.Minute)),
+			testCheckin(4, "carol", 1, 4, at),
+		}
+		// Start from a different order each time
+		checkins[0], checkins[i%4] = checkins[i%4], checkins[0]
+		sort.Sort(byCheckinTime(checkins))
+		got := make([]int, 0, len(checkins))
+		for _, c := range checkins {
+			got = append(got, c.ID)
+		}
+		if got[0] != 9 || got[1] != 3 || got[2] != 4 || got[3] != 5 {
+			t.Fatalf("got %v, want 9 first and the ties by ID", got)
+		}
+	}
+}
+
+// readTestConfig reads the config from body, written to a file.
+func readTestConfig(t *testing.T, body string) (Config, error) {
+	t.Helper()
+	fileName := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(fileName, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return readConfigFile(fileName)
+}
+
+func TestInitialFetchCount(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+
+	c, err := readTestConfig(t, `{"users": [{"name": "alice"}, {"name": "bob", "history_limit": 1000}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.InitialFetchCount != CheckinApiLimit {
+		t.Errorf("got %d by default, want %d", c.InitialFetchCount, CheckinApiLimit)
+	}
+
+	c, err = readTestConfig(t, `{"initial_fetch_count": 50, "users": [{"name": "alice"}, {"name": "bob", "history_limit": 1000}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config = c
+	if n := historyLimit("alice"); n != 50 {
+		t.Errorf("got %d for alice, want 50", n)
+	}
+	if n := historyLimit("bob"); n != 1000 {
+		t.Errorf("got %d for bob, want his history_limit", n)
+	}
+	if n := historyLimit("Bob"); n != 1000 {
+		t.Errorf("got %d for Bob, want the history_limit of bob", n)
+	}
+
+	for _, n := range []string{"-1", "301"} {
+		if _, err := readTestConfig(t, `{"initial_fetch_count": `+n+`}`); err == nil {
+			t.Errorf("got no error for %s", n)
+		}
+	}
+}
+
+func TestReducedInitialFetch(t *testing.T) {
+	source := newFakeSource(testCheckins("alice", 1, 200)...)
+	checkins, limited := getAllCheckins(context.Background(), "alice", 0, 50, source, newApiBudget(ApiCallsPerHour))
+	if len(checkins) != 50 || !limited || source.callCount() != 1 {
+		t.Errorf("got %d checkins in %d calls, limited %v, want 50 in 1 call", len(checkins), source.callCount(), limited)
+	}
+}
+
+// runPollCycle runs untappdLoop until it has filled the cache and finished
+// one poll cycle, and returns everything it posted. Checkins for the
+// webhook are queued on webhooks, if not nil.
+func runPollCycle(t *testing.T, source *fakeSource, store *checkinStore, budget *apiBudget, webhooks chan *untappd.Checkin) []string {
+	t.Helper()
+	cs := make(chan string, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		untappdLoop(ctx, cs, nil, source, store, newLinkStore(&settingsStore{}), budget, webhooks)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !lastPoll.lastPolled().After(start) {
+		if time.Now().After(deadline) {
+			cancel()
+			t.Fatal("no poll cycle finished")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	close(cs)
+	messages := make([]string, 0)
+	for m := range cs {
+		messages = append(messages, m)
+	}
+	return messages
+}
+
+func TestUntappdLoopSkipsUsersWhenBudgetIsLow(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config = Config{
+		Users:             []User{{Name: "alice"}, {Name: "bob"}, {Name: "carol"}},
+		Location:          time.UTC,
+		InitialFetchCount: CheckinApiLimit,
+		StartupStats:      "off",
+		UnreachableAfter:  5,
+	}
+
+	source := newFakeSource(append(testCheckins("alice", 1, 1),
+		append(testCheckins("bob", 2, 1), testCheckins("carol", 3, 1)...)...)...)
+	// Filling the cache takes two calls per user, which leaves enough for
+	// polling one user before reaching the reserve
+	budget := newApiBudget(6 + budgetReserve + 1)
+	runPollCycle(t, source, newCheckinStore(), budget, nil)
+
+	if got := strings.Join(source.polled, ","); got != "alice" {
+		t.Errorf("polled %s, want only alice before the budget ran low", got)
+	}
+	if got := strings.Join(rotateUsers([]string{"alice", "bob", "carol"}, 1), ","); got != "bob,carol,alice" {
+		t.Errorf("got the order %s for the next cycle, want the skipped users first", got)
+	}
+}
+
+func TestDeletedCheckins(t *testing.T) {
+	cached := testCheckins("alice", 1, 10)
+	// The latest page covers checkins 6 to 10, of which 8 is gone
+	fetched := []*untappd.Checkin{cached[9], cached[8], cached[6], cached[5]}
+
+	deleted := deletedCheckins(fetched, cached)
+	if len(deleted) != 1 || deleted[0].ID != 8 {
+		t.Errorf("got %v, want checkin 8 deleted", ids(deleted))
+	}
+
+	// Older checkins are not on the page, but not deleted
+	if deleted := deletedCheckins(fetched[:1], cached); len(deleted) != 0 {
+		t.Errorf("got %v, want none deleted", ids(deleted))
+	}
+	// A failed fetch says nothing
+	if deleted := deletedCheckins(nil, cached); len(deleted) != 0 {
+		t.Errorf("got %v for no checkins fetched, want none deleted", ids(deleted))
+	}
+}
+
+func TestUntappdLoopRemovesDeletedCheckins(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config = Config{
+		Users:             []User{{Name: "alice"}},
+		Location:          time.UTC,
+		InitialFetchCount: CheckinApiLimit,
+		StartupStats:      "off",
+		UnreachableAfter:  5,
+		AnnounceDeletions: true,
+	}
+
+	source := newFakeSource(testCheckins("alice", 1, 5)...)
+	source.deleted["alice"] = []int{3}
+	store := newCheckinStore()
+	messages := runPollCycle(t, source, store, newApiBudget(ApiCallsPerHour), nil)
+
+	if cached, _ := store.Get("alice"); len(cached) != 4 || store.Has("alice", 3) {
+		t.Errorf("cached %v, want checkin 3 removed", ids(cached))
+	}
+	if len(messages) != 1 || !strings.Contains(messages[0], "deleted their checkin of Beer 3") {
+		t.Errorf("got %q, want the deletion announced", messages)
+	}
+}
+
+func TestIsRatingAnnounced(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	tests := []struct {
+		min    float64
+		rating float64
+		want   bool
+	}{
+		{0, 0, true},
+		{0, 0.25, true},
+		{3, 0, true},
+		{3, 2.75, false},
+		{3, 3, true},
+		{3, 3.25, true},
+		{5, 4.75, false},
+		{5, 5, true},
+	}
+	for _, tt := range tests {
+		config = Config{MinRating: tt.min}
+		if got := isRatingAnnounced(tt.rating); got != tt.want {
+			t.Errorf("min_rating %v, rating %v: got %v, want %v", tt.min, tt.rating, got, tt.want)
+		}
+	}
+}
+
+func TestFormatBadges(t *testing.T) {
+	checkin := testCheckin(1, "alice", 1, 4, time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	if got := formatBadges(checkin); got != "" {
+		t.Errorf("got %q without badges, want none", got)
+	}
+
+	// The client allocates the badges by count, but may fill in fewer
+	checkin.Badges = []*untappd.Badge{{Name: "Hopped Up (Level 3)"}, nil, {Name: "Untappd at Home"}, nil}
+	if got := formatBadges(checkin); got != "  🏅 Earned: Hopped Up (Level 3), Untappd at Home" {
+		t.Errorf("got %q, want both badges", got)
+	}
+	checkin.Badges = []*untappd.Badge{nil, nil}
+	if got := formatBadges(checkin); got != "" {
+		t.Errorf("got %q with only nil badges, want none", got)
+	}
+
+	checkin.Badges = nil
+	for i := 0; i < 30; i++ {
+		checkin.Badges = append(checkin.Badges, &untappd.Badge{Name: "A Badge With A Long Name"})
+	}
+	if got := formatBadges(checkin); utf8.RuneCountInString(got) > badgesMaxLength {
+		t.Errorf("got %d runes, want at most %d", utf8.RuneCountInString(got), badgesMaxLength)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := Config{
+		ClientId:     "id",
+		ClientSecret: "secret",
+		Server:       "irc.example.org:6697",
+		BotName:      "untappdbot",
+		Channels:     stringList{"#beer"},
+		Users:        []User{{Name: "alice"}},
+	}
+
+	tests := []struct {
+		name    string
+		change  func(c *Config)
+		missing string
+	}{
+		{"valid", func(c *Config) {}, ""},
+		{"client_id", func(c *Config) { c.ClientId = "" }, "client_id"},
+		{"client_secret", func(c *Config) { c.ClientSecret = "" }, "client_secret"},
+		{"server", func(c *Config) { c.Server = "" }, "server"},
+		{"bot_name", func(c *Config) { c.BotName = "" }, "bot_name"},
+		{"channel", func(c *Config) { c.Channels = nil }, "channel"},
+		{"users", func(c *Config) { c.Users = nil }, "users"},
+		{"user name", func(c *Config) { c.Users = append(c.Users, User{}) }, "users[1].name"},
+		{"several", func(c *Config) { c.ClientId, c.BotName = "", "" }, "client_id, bot_name"},
+	}
+	for _, tt := range tests {
+		c := valid
+		c.Users = append([]User(nil), valid.Users...)
+		tt.change(&c)
+		err := c.validate()
+		switch {
+		case tt.missing == "" && err != nil:
+			t.Errorf("%s: got %s, want no error", tt.name, err)
+		case tt.missing != "" && (err == nil || !strings.HasSuffix(err.Error(), ": "+tt.missing)):
+			t.Errorf("%s: got %v, want %s missing", tt.name, err, tt.missing)
+		}
+	}
+}
+
+func TestIsFirstInGroup(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	checkin := testCheckin(10, "alice", 1, 4, start.Add(10*time.Hour))
+	userCheckins := map[string][]*untappd.Checkin{
+		"alice": {testCheckin(1, "alice", 2, 4, start), checkin},
+		"bob":   {testCheckin(2, "bob", 3, 4, start)},
+	}
+	if !isFirstInGroup(checkin, userCheckins, nil) {
+		t.Error("nobody had beer 1 before, want alice first")
+	}
+
+	// Bob had it later, which doesn't change who was first
+	userCheckins["bob"] = append(userCheckins["bob"], testCheckin(11, "bob", 1, 4, start.Add(11*time.Hour)))
+	if !isFirstInGroup(checkin, userCheckins, nil) {
+		t.Error("bob had beer 1 after alice, want alice still first")
+	}
+
+	userCheckins["bob"] = append(userCheckins["bob"], testCheckin(3, "bob", 1, 4, start.Add(time.Hour)))
+	if isFirstInGroup(checkin, userCheckins, nil) {
+		t.Error("bob had beer 1 before alice, want alice not first")
+	}
+
+	// Carol's older checkins are not cached, and may include beer 1
+	userCheckins["bob"] = userCheckins["bob"][:1]
+	userCheckins["carol"] = []*untappd.Checkin{testCheckin(4, "carol", 5, 4, start)}
+	if isFirstInGroup(checkin, userCheckins, map[string]bool{"carol": true}) {
+		t.Error("carol is capped, want nobody first")
+	}
+}
+
+func TestSendCheckinFirstInChannel(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config = Config{Location: time.UTC}
+	checkin := testCheckin(1, "alice", 1, 4, time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	userCheckins := map[string][]*untappd.Checkin{"alice": {checkin}, "bob": testCheckins("bob", 10, 2)}
+
+	first := func(capped map[string]bool) bool {
+		cs := make(chan string, 100)
+		sendCheckinToIrc(context.Background(), checkin, cs, userCheckins, capped, newLinkStore(&settingsStore{}), true)
+		close(cs)
+		for line := range cs {
+			if strings.Contains(line, "First in the channel") {
+				return true
+			}
+		}
+		return false
+	}
+	if first(nil) {
+		t.Error("want nothing announced with show_first_in_channel off")
+	}
+	config.ShowFirstInChannel = true
+	if !first(nil) {
+		t.Error("want the first in the channel announced")
+	}
+	if first(map[string]bool{"bob": true}) {
+		t.Error("want nothing announced while bob is capped")
+	}
+}
+
+// captureSink records the messages pushMessage delivers.
+type captureSink struct {
+	mu     sync.Mutex
+	sent   []targetedMessage
+	topics []targetedMessage
+}
+
+func (c *captureSink) send(target string, text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sent = append(c.sent, targetedMessage{target: target, text: text})
+}
+
+func (c *captureSink) topic(channel string, text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.topics = append(c.topics, targetedMessage{target: channel, text: text})
+}
+
+func TestPushMessage(t *testing.T) {
+	sink := &captureSink{}
+	cs := make(chan string)
+	targeted := make(chan targetedMessage)
+	topics := make(chan string)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		pushMessage(ctx, sink, cs, targeted, topics, []string{"#beer", "#pub"})
+		close(done)
+	}()
+
+	cs <- "alice had a beer"
+	cs <- strings.Repeat("long ", 100)
+	targeted <- targetedMessage{target: "bob", text: "psst"}
+	topics <- "Latest: alice had a beer"
+	cancel()
+	<-done
+
+	// The long message is split in two lines, each sent to both channels
+	if len(sink.sent) != 7 {
+		t.Fatalf("sent %d lines, want 7: %v", len(sink.sent), sink.sent)
+	}
+	for i, want := range []string{"#beer", "#pub", "#beer", "#beer", "#pub", "#pub", "bob"} {
+		if sink.sent[i].target != want {
+			t.Errorf("sent line %d to %s, want %s", i, sink.sent[i].target, want)
+		}
+		if len(sink.sent[i].text) > maxMessageBytes {
+			t.Errorf("sent a line of %d bytes", len(sink.sent[i].text))
+		}
+	}
+	if len(sink.topics) != 2 || sink.topics[1].text != "Latest: alice had a beer" {
+		t.Errorf("got topics %v, want both channels", sink.topics)
+	}
+}
+
+func TestLogSink(t *testing.T) {
+	var buf strings.Builder
+	log.SetOutput(&buf)
+	defer log.SetOutput(ioutil.Discard)
+
+	logSink{}.send("#beer", "\x02alice\x02 had a beer")
+	logSink{}.topic("#beer", "Latest")
+	out := buf.String()
+	if !strings.Contains(out, "alice had a beer") || strings.Contains(out, "\x02") {
+		t.Errorf("got %q, want the message without formatting", out)
+	}
+	if !strings.Contains(out, "dry_run") || !strings.Contains(out, "Latest") {
+		t.Errorf("got %q, want the topic logged as a dry run", out)
+	}
+}
+
+func TestHighlightVenues(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config = Config{Location: time.UTC, HighlightVenues: []string{"the local"}, ShownFields: map[string]bool{"general": true}}
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		venue *untappd.Venue
+		want  bool
+	}{
+		{"match", &untappd.Venue{ID: 42, Name: "The Local"}, true},
+		{"no match", &untappd.Venue{ID: 7, Name: "Alice's Home"}, false},
+		{"no venue", nil, false},
+	}
+	for _, tt := range tests {
+		checkin := testCheckin(1, "alice", 1, 4, start)
+		checkin.Venue = tt.venue
+		lines := announced(checkin, map[string][]*untappd.Checkin{"alice": {checkin}})
+		if got := strings.HasPrefix(lines[0], "📍 LOCAL: "); got != tt.want {
+			t.Errorf("%s: got %q, want highlighted %v", tt.name, lines[0], tt.want)
+		}
+	}
+}
+
+func TestUserStatsWithoutCheckins(t *testing.T) {
+	for _, checkins := range [][]*untappd.Checkin{nil, {}} {
+		if count, avg, stdev := getUserStats(checkins); count != 0 || avg != 0 || stdev != 0 {
+			t.Errorf("got %d, %v, %v, want zeros", count, avg, stdev)
+		}
+		if s := formatUserStats("alice", checkins); s != "untappd stats for alice: no checkins yet." {
+			t.Errorf("got %q, want no checkins yet", s)
+		}
+	}
+
+	unrated := testCheckins("alice", 1, 3)
+	for _, c := range unrated {
+		c.UserRating = 0
+	}
+	if s := formatUserStats("alice", unrated); strings.Contains(s, "NaN") {
+		t.Errorf("got %q for unrated checkins", s)
+	}
+}
+
+func TestStatsSkipUnratedCheckins(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	checkins := []*untappd.Checkin{
+		testCheckin(1, "alice", 1, 3, start),
+		testCheckin(2, "alice", 1, 0, start.Add(time.Hour)),
+		testCheckin(3, "alice", 1, 4, start.Add(2*time.Hour)),
+		testCheckin(4, "alice", 1, 0, start.Add(3*time.Hour)),
+		testCheckin(5, "alice", 2, 0, start.Add(4*time.Hour)),
+	}
+
+	min, max, avg, count, last := getStats(checkins, &untappd.Beer{ID: 1})
+	if min != 3 || max != 4 || avg != 3.5 || count != 4 || last.ID != 4 {
+		t.Errorf("got %v, %v, %v, %d, %d, want 3, 4, 3.5, 4 checkins, the latest 4", min, max, avg, count, last.ID)
+	}
+	min, max, avg, count, last = getStats(checkins, &untappd.Beer{ID: 2})
+	if min != 0 || max != 0 || avg != 0 || count != 1 || last.ID != 5 {
+		t.Errorf("got %v, %v, %v, %d, %d for an unrated beer, want zero ratings", min, max, avg, count, last.ID)
+	}
+
+	total, mean, stdev := getUserStats(checkins)
+	if total != 5 || mean != 3.5 || stdev != 0.5 {
+		t.Errorf("got %d, %v, %v, want 5 checkins, 3.5 average, 0.5 stdev", total, mean, stdev)
+	}
+	want := "untappd stats for alice: 5 checkins (2 rated) with 3.50 average rating [stdev: 0.50]."
+	if s := formatUserStats("alice", checkins); s != want {
+		t.Errorf("got %q, want %q", s, want)
+	}
+}
+
+func TestDecayedAverage(t *testing.T) {
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	beer := &untappd.Beer{ID: 1}
+	checkins := []*untappd.Checkin{
+		testCheckin(1, "bob", 1, 1, now.AddDate(-1, 0, 0)),
+		testCheckin(2, "bob", 1, 0, now.AddDate(0, -1, 0)),
+		testCheckin(3, "bob", 1, 4.5, now.AddDate(0, 0, -1)),
+		testCheckin(4, "bob", 2, 5, now),
+	}
+
+	_, _, avg, _, _ := getStats(checkins, beer)
+	decayed, ok := decayedAverage(checkins, beer, 30*24*time.Hour, now)
+	if !ok {
+		t.Fatal("got no decayed average")
+	}
+	// The year old low rating barely counts against the recent high one
+	if decayed < 4.4 || decayed <= avg {
+		t.Errorf("got %0.2f decayed, %0.2f simple, want the recent 4.5 to outweigh the old 1", decayed, avg)
+	}
+
+	// However old, a single rating is the average
+	if decayed, _ := decayedAverage(checkins[:1], beer, 30*24*time.Hour, now); math.Abs(decayed-1) > 1e-9 {
+		t.Errorf("got %0.2f for a single rating, want 1", decayed)
+	}
+	if _, ok := decayedAverage(checkins[1:2], beer, time.Hour, now); ok {
+		t.Error("got a decayed average of an unrated checkin")
+	}
+}
+
+func TestParseServer(t *testing.T) {
+	tests := []struct {
+		server string
+		tls    bool
+		want   string
+	}{
+		{"irc.example.org", true, "irc.example.org:6697"},
+		{"irc.example.org", false, "irc.example.org:6667"},
+		{"irc.example.org:7000", true, "irc.example.org:7000"},
+		{"192.0.2.1", true, "192.0.2.1:6697"},
+		{"192.0.2.1:6667", true, "192.0.2.1:6667"},
+		{"2001:db8::1", true, "[2001:db8::1]:6697"},
+		{"[2001:db8::1]", true, "[2001:db8::1]:6697"},
+		{"[2001:db8::1]:7000", true, "[2001:db8::1]:7000"},
+	}
+	for _, tt := range tests {
+		got, err := parseServer(tt.server, tt.tls)
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %q, %v, want %q", tt.server, got, err, tt.want)
+		}
+	}
+
+	for _, server := range []string{"", ":6697", "irc.example.org:", "irc.example.org:port",
+		"irc.example.org:70000", "irc.example.org:6697:1", "[2001:db8::1", "irc example.org"} {
+		if got, err := parseServer(server, true); err == nil {
+			t.Errorf("%q: got %q, want an error", server, got)
+		}
+	}
+}
+
+func TestFormatCheckinCommunityRating(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	checkin := testCheckin(1, "alice", 1, 4, time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	checkin.Beer.OverallRating = 3.8
+	rating := func() string {
+		_, _, r, _ := formatCheckin(checkin)
+		return stripFormatting(r)
+	}
+
+	config = Config{}
+	if r := rating(); strings.Contains(r, "community") {
+		t.Errorf("got %q with show_community_rating off", r)
+	}
+	config.ShowCommunityRating = true
+	if r := rating(); !strings.HasPrefix(r, "  Rating: 4.0 (community 3.80)") {
+		t.Errorf("got %q, want the community rating", r)
+	}
+	checkin.Beer.OverallRating = 0
+	if r := rating(); strings.Contains(r, "community") {
+		t.Errorf("got %q without a community rating from untappd", r)
+	}
+}
+
+func TestFormatCombinedStats(t *testing.T) {
+	userCheckins := map[string][]*untappd.Checkin{
+		"carol": {},
+		"bob":   testCheckins("bob", 10, 2),
+		"alice": testCheckins("alice", 1, 3),
+	}
+	userCheckins["alice"][0].UserRating = 4.5
+
+	want := "untappd stats: alice 3 (3.83), bob 2 (3.50), carol 0 (0.00)."
+	if s := formatCombinedStats(userCheckins, nil); s != want {
+		t.Errorf("got %q, want %q", s, want)
+	}
+	want = "untappd stats: alice 3 (3.83), bob 2* (3.50), carol 0 (0.00). * Only the latest checkins are counted."
+	if s := formatCombinedStats(userCheckins, map[string]bool{"bob": true}); s != want {
+		t.Errorf("got %q, want %q", s, want)
+	}
+
+	// Many users are split over a few lines, not one each
+	for i := 0; i < 30; i++ {
+		user := "user" + strconv.Itoa(i)
+		userCheckins[user] = testCheckins(user, 100+i*10, 2)
+	}
+	lines := splitMessage(formatCombinedStats(userCheckins, nil), maxMessageBytes)
+	if len(lines) < 2 || len(lines) > 3 {
+		t.Errorf("got %d lines for 33 users, want 2 or 3", len(lines))
+	}
+}
+
+func TestIgnoredUsers(t *testing.T) {
+	configured := []User{{Name: "alice"}, {Name: "Bob"}, {Name: "carol"}}
+	saved := []User{{Name: "bob"}, {Name: "dave"}}
+	if got := ignoredUsers(configured, saved); strings.Join(got, ",") != "alice,carol" {
+		t.Errorf("got %q, want alice and carol", got)
+	}
+	if got := ignoredUsers(configured, configured); len(got) != 0 {
+		t.Errorf("got %q, want none", got)
+	}
+}
+
+func TestUntappdLoopStopsWhenCancelled(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config = Config{
+		Users:             []User{{Name: "alice"}, {Name: "bob"}},
+		Location:          time.UTC,
+		InitialFetchCount: CheckinApiLimit,
+		StartupStats:      "off",
+		UnreachableAfter:  5,
+		CacheFile:         filepath.Join(t.TempDir(), "cache.json"),
+	}
+
+	source := newFakeSource(append(testCheckins("alice", 1, 5), testCheckins("bob", 100, 5)...)...)
+	source.pending["alice"] = testCheckins("alice", 6, 5)
+	ctx, cancel := context.WithCancel(context.Background())
+	// Shut down while polling alice
+	source.onPoll = func(user string) {
+		if user == "alice" {
+			cancel()
+		}
+	}
+
+	// Nobody reads the messages, as after pushMessage has stopped
+	done := make(chan struct{})
+	go func() {
+		untappdLoop(ctx, make(chan string), nil, source, newCheckinStore(), newLinkStore(&settingsStore{}), newApiBudget(ApiCallsPerHour), nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("poll loop blocked after being cancelled")
+	}
+
+	if got := strings.Join(source.polled, ","); got != "alice" {
+		t.Errorf("polled %s, want to stop after alice", got)
+	}
+	cached, _, err := loadCache(config.CacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cached["alice"]) != 10 || len(cached["bob"]) != 5 {
+		t.Errorf("cached %d and %d checkins, want alice's new checkins saved", len(cached["alice"]), len(cached["bob"]))
+	}
+}
+
+func TestIsNewRelease(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	checkin := testCheckin(10, "alice", 1, 4, start.Add(10*time.Hour))
+	known := testCheckin(1, "bob", 2, 4, start)
+	known.Brewery = checkin.Brewery
+	userCheckins := map[string][]*untappd.Checkin{
+		"alice": {checkin},
+		"bob":   {known},
+		"carol": {testCheckin(2, "carol", 3, 4, start)},
+	}
+
+	if !isNewRelease(checkin, userCheckins, nil) {
+		t.Error("nobody had beer 1 from a known brewery, want a new release")
+	}
+	// Carol's older checkins are not cached, and may include beer 1
+	if isNewRelease(checkin, userCheckins, map[string]bool{"carol": true}) {
+		t.Error("carol is capped, want no new release")
+	}
+	userCheckins["carol"] = append(userCheckins["carol"], testCheckin(3, "carol", 1, 4, start))
+	if isNewRelease(checkin, userCheckins, nil) {
+		t.Error("carol had beer 1, want no new release")
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// histogram is a prometheus histogram with fixed buckets.
+type histogram struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	buckets []float64 // upper bounds, ascending
+	counts  []uint64  // observations per bucket, not cumulative
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(name string, help string, buckets []float64) *histogram {
+	return &histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// write writes the histogram in the prometheus text format.
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n",
+			h.name, strconv.FormatFloat(bound, 'f', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, strconv.FormatFloat(h.sum, 'f', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// counter is a prometheus counter.
+type counter struct {
+	mu    sync.Mutex
+	name  string
+	help  string
+	value uint64
+}
+
+func newCounter(name string, help string) *counter {
+	return &counter{name: name, help: help}
+}
+
+func (c *counter) inc() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.value++
+}
+
+func (c *counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+	fmt.Fprintf(w, "%s %d\n", c.name, c.value)
+}
+
+// gauge is a prometheus gauge.
+type gauge struct {
+	mu    sync.Mutex
+	name  string
+	help  string
+	value float64
+}
+
+func newGauge(name string, help string) *gauge {
+	return &gauge{name: name, help: help}
+}
+
+func (g *gauge) set(v float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.value = v
+}
+
+func (g *gauge) get() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.value
+}
+
+func (g *gauge) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", g.name, g.help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", g.name)
+	fmt.Fprintf(w, "%s %s\n", g.name, strconv.FormatFloat(g.value, 'f', -1, 64))
+}
+
+var checkinsAnnounced = newCounter("untappd_checkins_announced_total",
+	"Checkins announced in irc.")
+
+var apiCalls = newCounter("untappd_api_calls_total",
+	"Calls made to the untappd api.")
+
+var apiErrors = newCounter("untappd_api_errors_total",
+	"Calls to the untappd api which failed.")
+
+var apiRetries = newCounter("untappd_api_retries_total",
+	"Failed calls to the untappd api which were retried.")
+
+var pollInterval = newGauge("untappd_poll_interval_seconds",
+	"Time until the next poll of untappd.")
+
+var ratingHistogram = newHistogram("untappd_announced_rating",
+	"Ratings of the announced checkins.",
+	[]float64{0.5, 1, 1.5, 2, 2.5, 3, 3.5, 4, 4.5, 5})
+
+// Number of poll intervals without a finished poll cycle after which the
+// bot is reported unhealthy.
+const healthMissedPolls = 3
+
+// pollHealth is when the last poll cycle finished, and how long until
+// the next one was due.
+type pollHealth struct {
+	mu       sync.Mutex
+	last     time.Time
+	interval time.Duration
+}
+
+var lastPoll = &pollHealth{}
+
+// polled records that a poll cycle finished at now, and the next one is
+// due after interval.
+func (h *pollHealth) polled(now time.Time, interval time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last = now
+	h.interval = interval
+}
+
+// lastPolled returns when the last poll cycle finished, or the zero time
+// if none has.
+func (h *pollHealth) lastPolled() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.last
+}
+
+// check returns whether a poll cycle has finished recently enough, or
+// why not.
+func (h *pollHealth) check(now time.Time) (bool, string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.last.IsZero() {
+		return false, "no poll cycle has finished yet"
+	}
+	if since := now.Sub(h.last); since > healthMissedPolls*h.interval {
+		return false, fmt.Sprintf("last poll cycle finished %s ago", since.Round(time.Second))
+	}
+	return true, "ok"
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	ok, reason := lastPoll.check(time.Now())
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintln(w, reason)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	checkinsAnnounced.write(w)
+	apiCalls.write(w)
+	apiErrors.write(w)
+	apiRetries.write(w)
+	pollInterval.write(w)
+	ratingHistogram.write(w)
+}
+
+// serveMetrics serves the metrics on /metrics at addr, and the health of
+// the poll loop on /healthz.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/healthz", healthHandler)
+	infof("Serving metrics on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		warnf("Unable to serve metrics: %s", err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrape returns the value of a metric served by metricsHandler.
+func scrape(t *testing.T, name string) float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == name {
+			v, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+	}
+	t.Fatalf("no metric %s", name)
+	return 0
+}
+
+func TestMetricsHandler(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	config = Config{Location: time.UTC}
+
+	announcedBefore := scrape(t, "untappd_checkins_announced_total")
+	ratingsBefore := scrape(t, "untappd_announced_rating_count")
+	recordAnnounced(testCheckin(1, "alice", 1, 4, time.Now()))
+
+	if got := scrape(t, "untappd_checkins_announced_total"); got != announcedBefore+1 {
+		t.Errorf("got %v checkins announced, want %v", got, announcedBefore+1)
+	}
+	if got := scrape(t, "untappd_announced_rating_count"); got != ratingsBefore+1 {
+		t.Errorf("got %v ratings, want %v", got, ratingsBefore+1)
+	}
+
+	pollInterval.set(90)
+	if got := scrape(t, "untappd_poll_interval_seconds"); got != 90 {
+		t.Errorf("got a poll interval of %v, want 90", got)
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	h := newHistogram("test", "Test.", []float64{1, 2, 3})
+	for _, v := range []float64{0.5, 1, 2.5, 4} {
+		h.observe(v)
+	}
+	var b strings.Builder
+	h.write(&b)
+	for _, want := range []string{`test_bucket{le="1"} 2`, `test_bucket{le="2"} 2`,
+		`test_bucket{le="3"} 3`, `test_bucket{le="+Inf"} 4`, "test_sum 8", "test_count 4"} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("got\n%s\nwant %s", b.String(), want)
+		}
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	defer func(h *pollHealth) { lastPoll = h }(lastPoll)
+	lastPoll = &pollHealth{}
+
+	check := func() int {
+		rec := httptest.NewRecorder()
+		healthHandler(rec, httptest.NewRequest("GET", "/healthz", nil))
+		return rec.Code
+	}
+	if code := check(); code != http.StatusServiceUnavailable {
+		t.Errorf("got %d before the first poll, want 503", code)
+	}
+	lastPoll.polled(time.Now(), time.Minute)
+	if code := check(); code != http.StatusOK {
+		t.Errorf("got %d after a poll, want 200", code)
+	}
+	lastPoll.polled(time.Now().Add(-time.Hour), time.Minute)
+	if code := check(); code != http.StatusServiceUnavailable {
+		t.Errorf("got %d after missing polls, want 503", code)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var pasteClient = &http.Client{Timeout: 10 * time.Second}
+
+// uploadPaste uploads text to the configured paste service and returns
+// the link to it.
+func uploadPaste(text string) (string, error) {
+	field := config.PasteField
+	if field == "" {
+		field = "file"
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile(field, "stats.txt")
+	if err != nil {
+		return "", err
+	}
+	if _, err := part.Write([]byte(text)); err != nil {
+		return "", err
+	}
+	if err := form.Close(); err != nil {
+		return "", err
+	}
+
+	res, err := pasteClient.Post(config.PasteURL, form.FormDataContentType(), &body)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	link, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("paste service returned %s", res.Status)
+	}
+
+	return strings.TrimSpace(string(link)), nil
+}
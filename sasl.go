@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/nickvanw/ircx/v2"
+	irc "gopkg.in/sorcix/irc.v2"
+)
+
+// Maximum length of an AUTHENTICATE parameter, longer payloads are split.
+const saslChunkSize int = 400
+
+// saslAuth authenticates with SASL PLAIN while registering with the irc
+// server, negotiated with CAP. If the server doesn't offer SASL, the bot
+// connects without it.
+type saslAuth struct {
+	user     string
+	password string
+	offered  bool // the server listed sasl in CAP LS
+}
+
+func newSASLAuth(user string, password string) *saslAuth {
+	return &saslAuth{user: user, password: password}
+}
+
+// start asks the server for its capabilities. connect sends it before
+// NICK and USER, which makes the server wait for CAP END before completing
+// the registration.
+func (a *saslAuth) start(s ircx.Sender) {
+	a.offered = false
+	s.Send(&irc.Message{Command: irc.CAP, Params: []string{irc.CAP_LS, "302"}})
+}
+
+func (a *saslAuth) end(s ircx.Sender) {
+	s.Send(&irc.Message{Command: irc.CAP, Params: []string{irc.CAP_END}})
+}
+
+func (a *saslAuth) CapHandler(s ircx.Sender, m *irc.Message) {
+	switch m.Param(1) {
+	case irc.CAP_LS:
+		for _, capability := range strings.Fields(m.Trailing()) {
+			if capability == "sasl" || strings.HasPrefix(capability, "sasl=") {
+				a.offered = true
+			}
+		}
+		// A "*" before the list means more lines follow
+		if len(m.Params) > 3 && m.Param(2) == "*" {
+			return
+		}
+		if !a.offered {
+			warnf("Server does not support SASL, connecting without it.")
+			a.end(s)
+			return
+		}
+		s.Send(&irc.Message{Command: irc.CAP, Params: []string{irc.CAP_REQ, "sasl"}})
+	case irc.CAP_ACK:
+		s.Send(&irc.Message{Command: irc.AUTHENTICATE, Params: []string{"PLAIN"}})
+	case irc.CAP_NAK:
+		warnf("Server refused SASL, connecting without it.")
+		a.end(s)
+	}
+}
+
+func (a *saslAuth) AuthenticateHandler(s ircx.Sender, m *irc.Message) {
+	if m.Param(0) != "+" {
+		return
+	}
+
+	// Never log the password
+	payload := base64.StdEncoding.EncodeToString([]byte(a.user + "\x00" + a.user + "\x00" + a.password))
+	for len(payload) >= saslChunkSize {
+		s.Send(&irc.Message{Command: irc.AUTHENTICATE, Params: []string{payload[:saslChunkSize]}})
+		payload = payload[saslChunkSize:]
+	}
+	if payload == "" {
+		payload = "+"
+	}
+	s.Send(&irc.Message{Command: irc.AUTHENTICATE, Params: []string{payload}})
+}
+
+func (a *saslAuth) SuccessHandler(s ircx.Sender, m *irc.Message) {
+	infof("Authenticated with SASL as %s.", a.user)
+	a.end(s)
+}
+
+func (a *saslAuth) FailureHandler(s ircx.Sender, m *irc.Message) {
+	warnf("SASL authentication failed, connecting without it: %s", m.Trailing())
+	a.end(s)
+}
+
+// RegisterHandlers adds the handlers for the CAP and SASL replies.
+func (a *saslAuth) RegisterHandlers(bot *ircx.Bot) {
+	bot.HandleFunc(irc.CAP, a.CapHandler)
+	bot.HandleFunc(irc.AUTHENTICATE, a.AuthenticateHandler)
+	bot.HandleFunc(irc.RPL_SASLSUCCESS, a.SuccessHandler)
+	bot.HandleFunc(irc.ERR_SASLFAIL, a.FailureHandler)
+	bot.HandleFunc(irc.ERR_SASLTOOLONG, a.FailureHandler)
+	bot.HandleFunc(irc.ERR_SASLABORTED, a.FailureHandler)
+}
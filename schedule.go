@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// clock is a time of day, parsed from "15:04".
+type clock struct {
+	hour   int
+	minute int
+}
+
+func parseClock(s string) (clock, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return clock{}, err
+	}
+	return clock{t.Hour(), t.Minute()}, nil
+}
+
+// next returns the first time after now at which the clock in loc shows c.
+// The time is computed from the calendar date rather than by adding a
+// fixed duration, so it stays at the same wall clock time across daylight
+// saving changes. A time skipped when the clocks go forward fires that
+// much later (02:30 becomes 03:30), and a time repeated when the clocks go
+// back fires once.
+func (c clock) next(now time.Time, loc *time.Location) time.Time {
+	now = now.In(loc)
+	t := time.Date(now.Year(), now.Month(), now.Day(), c.hour, c.minute, 0, 0, loc)
+	if !t.After(now) {
+		t = time.Date(now.Year(), now.Month(), now.Day()+1, c.hour, c.minute, 0, 0, loc)
+	}
+	return t
+}
+
+// runDaily calls f every day when the clock in config.Location shows c.
+// The next time is recomputed after every call, so a day which is 23 or 25
+// hours long does not make it drift.
+func runDaily(c clock, f func(now time.Time)) {
+	for {
+		next := c.next(time.Now(), config.Location)
+		time.Sleep(time.Until(next))
+		f(next)
+	}
+}
+
+// sleepContext sleeps for d, or until ctx is cancelled. It returns false
+// if it was cancelled.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// sendContext sends m on cs, unless ctx is cancelled first. It returns
+// false if it was cancelled.
+func sendContext(ctx context.Context, cs chan string, m string) bool {
+	select {
+	case cs <- m:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// window is a daily span of time, which may cross midnight.
+type window struct {
+	start clock
+	end   clock
+}
+
+// contains returns true if t, in loc, is within the window.
+func (w window) contains(t time.Time, loc *time.Location) bool {
+	t = t.In(loc)
+	m := t.Hour()*60 + t.Minute()
+	start := w.start.hour*60 + w.start.minute
+	end := w.end.hour*60 + w.end.minute
+	if start <= end {
+		return start <= m && m < end
+	}
+	return m >= start || m < end
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func loadLocation(t *testing.T, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("no time zone data: %s", err)
+	}
+	return loc
+}
+
+func TestClockNextAcrossDST(t *testing.T) {
+	oslo := loadLocation(t, "Europe/Oslo")
+	nine := clock{9, 0}
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want time.Time
+		gap  time.Duration
+	}{
+		// The clocks go forward at 02:00 on 28 March 2021
+		{"spring", time.Date(2021, 3, 27, 9, 0, 0, 0, oslo), time.Date(2021, 3, 28, 9, 0, 0, 0, oslo), 23 * time.Hour},
+		{"after spring", time.Date(2021, 3, 28, 9, 0, 0, 0, oslo), time.Date(2021, 3, 29, 9, 0, 0, 0, oslo), 24 * time.Hour},
+		// And back at 03:00 on 31 October 2021
+		{"fall", time.Date(2021, 10, 30, 9, 0, 0, 0, oslo), time.Date(2021, 10, 31, 9, 0, 0, 0, oslo), 25 * time.Hour},
+		{"later today", time.Date(2021, 10, 31, 8, 0, 0, 0, oslo), time.Date(2021, 10, 31, 9, 0, 0, 0, oslo), time.Hour},
+	}
+	for _, tt := range tests {
+		got := nine.next(tt.now, oslo)
+		if !got.Equal(tt.want) {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+		if gap := got.Sub(tt.now); gap != tt.gap {
+			t.Errorf("%s: got %s until the next time, want %s", tt.name, gap, tt.gap)
+		}
+		if h, m, _ := got.In(oslo).Clock(); h != 9 || m != 0 {
+			t.Errorf("%s: got %02d:%02d, want 09:00", tt.name, h, m)
+		}
+	}
+}
+
+func TestClockNextSkippedAndRepeated(t *testing.T) {
+	oslo := loadLocation(t, "Europe/Oslo")
+	halfPastTwo := clock{2, 30}
+
+	// 02:30 doesn't exist on 28 March 2021, it fires an hour later instead
+	got := halfPastTwo.next(time.Date(2021, 3, 28, 0, 0, 0, 0, oslo), oslo)
+	if h, m, _ := got.Clock(); got.Day() != 28 || h != 3 || m != 30 {
+		t.Errorf("got %s, want 03:30 on the day the clocks go forward", got)
+	}
+
+	// 02:30 happens twice on 31 October 2021, it fires only once
+	first := halfPastTwo.next(time.Date(2021, 10, 31, 0, 0, 0, 0, oslo), oslo)
+	if h, m, _ := first.Clock(); first.Day() != 31 || h != 2 || m != 30 {
+		t.Errorf("got %s, want 02:30 on the day the clocks go back", first)
+	}
+	second := halfPastTwo.next(first, oslo)
+	if second.Day() != 1 || second.Month() != time.November {
+		t.Errorf("got %s after %s, want 02:30 the next day", second, first)
+	}
+}
+
+func TestWindowContainsAcrossDST(t *testing.T) {
+	oslo := loadLocation(t, "Europe/Oslo")
+	night := window{clock{23, 0}, clock{6, 0}}
+
+	tests := []struct {
+		t    time.Time
+		want bool
+	}{
+		{time.Date(2021, 3, 28, 1, 30, 0, 0, oslo), true},
+		{time.Date(2021, 3, 28, 5, 59, 0, 0, oslo), true},
+		{time.Date(2021, 3, 28, 6, 0, 0, 0, oslo), false},
+		{time.Date(2021, 10, 31, 23, 0, 0, 0, oslo), true},
+		{time.Date(2021, 10, 31, 12, 0, 0, 0, oslo), false},
+		// 04:30 UTC is 05:30 in winter time, but 06:30 in summer time
+		{time.Date(2021, 10, 31, 4, 30, 0, 0, time.UTC), true},
+		{time.Date(2021, 3, 28, 4, 30, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		if got := night.contains(tt.t, oslo); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.t.In(oslo), got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// settings are changed at runtime through commands, and saved to
+// config.SettingsFile so that they survive restarts.
+type settings struct {
+	LogLevel string          `json:"log_level,omitempty"`
+	Flags    map[string]bool `json:"flags,omitempty"`
+	// Tracked users, when changed with !track or !untrack.
+	Users []User `json:"users,omitempty"`
+	// Irc nicks linked to untappd users with !link, by untappd user.
+	Links map[string]string `json:"links,omitempty"`
+}
+
+// settingsStore holds the runtime settings and the file they are saved to.
+type settingsStore struct {
+	mu       sync.Mutex
+	fileName string
+	values   settings
+}
+
+// loadSettings reads the saved settings. A missing file gives empty
+// settings.
+func loadSettings(fileName string) (*settingsStore, error) {
+	s := &settingsStore{fileName: fileName}
+	if fileName == "" {
+		return s, nil
+	}
+
+	body, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+
+	return s, json.Unmarshal(body, &s.values)
+}
+
+// saved returns whether the settings are saved to a file, and so kept
+// across restarts.
+func (s *settingsStore) saved() bool {
+	return s.fileName != ""
+}
+
+// update changes the settings and saves them.
+func (s *settingsStore) update(f func(*settings)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f(&s.values)
+	if s.fileName == "" {
+		return nil
+	}
+
+	body, err := json.MarshalIndent(s.values, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.fileName, body, 0644)
+}
+
+// get returns a copy of the settings.
+func (s *settingsStore) get() settings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	values := s.values
+	values.Flags = make(map[string]bool, len(s.values.Flags))
+	for name, value := range s.values.Flags {
+		values.Flags[name] = value
+	}
+	values.Users = append([]User(nil), s.values.Users...)
+	values.Links = make(map[string]string, len(s.values.Links))
+	for user, nick := range s.values.Links {
+		values.Links[user] = nick
+	}
+	return values
+}
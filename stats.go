@@ -0,0 +1,609 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mdlayher/untappd"
+)
+
+// styleCount is the number of checkins of a single beer style.
+type styleCount struct {
+	style string
+	count int
+}
+
+// styleHistogram counts the checkins of each beer style.
+func styleHistogram(checkins []*untappd.Checkin) map[string]int {
+	histogram := make(map[string]int)
+	for _, checkin := range checkins {
+		histogram[checkin.Beer.Style]++
+	}
+	return histogram
+}
+
+// topStyles returns the n most common styles in the histogram, most common
+// first. Ties are broken alphabetically.
+func topStyles(histogram map[string]int, n int) []styleCount {
+	styles := make([]styleCount, 0, len(histogram))
+	for style, count := range histogram {
+		styles = append(styles, styleCount{style, count})
+	}
+	sort.Slice(styles, func(i, j int) bool {
+		if styles[i].count != styles[j].count {
+			return styles[i].count > styles[j].count
+		}
+		return styles[i].style < styles[j].style
+	})
+
+	return styles[:min(n, len(styles))]
+}
+
+// favoriteStyle returns the style a user has checked in most often.
+func favoriteStyle(checkins []*untappd.Checkin) string {
+	top := topStyles(styleHistogram(checkins), 1)
+	if len(top) == 0 {
+		return ""
+	}
+	return top[0].style
+}
+
+// checkinsByBeer groups the checkins of all users by beer ID. The checkins
+// of each beer are sorted oldest first.
+func checkinsByBeer(userCheckins map[string][]*untappd.Checkin) map[int][]*untappd.Checkin {
+	beers := make(map[int][]*untappd.Checkin)
+	for _, checkins := range userCheckins {
+		for _, c := range checkins {
+			beers[c.Beer.ID] = append(beers[c.Beer.ID], c)
+		}
+	}
+	for _, checkins := range beers {
+		sort.Sort(byCheckinTime(checkins))
+	}
+	return beers
+}
+
+// A beer needs this many rated checkins, spread over at least
+// improvementMinSpan, to be considered by mostImproved.
+const improvementMinCheckins int = 4
+const improvementMinSpan time.Duration = 30 * 24 * time.Hour
+
+// improvement is how the group's rating of a beer changed from its earlier
+// to its later checkins.
+type improvement struct {
+	checkin *untappd.Checkin
+	before  float64
+	after   float64
+	count   int
+}
+
+// mostImproved finds the beer whose average rating in the later half of
+// its checkins rose the most compared to the earlier half.
+func mostImproved(userCheckins map[string][]*untappd.Checkin) (improvement, bool) {
+	var best improvement
+	found := false
+	for _, checkins := range checkinsByBeer(userCheckins) {
+		rated := ratedCheckins(checkins)
+		if len(rated) < improvementMinCheckins ||
+			rated[len(rated)-1].Created.Sub(rated[0].Created) < improvementMinSpan {
+			continue
+		}
+
+		half := len(rated) / 2
+		before := averageRating(rated[:half])
+		after := averageRating(rated[len(rated)-half:])
+		if after-before > best.after-best.before {
+			best = improvement{rated[len(rated)-1], before, after, len(rated)}
+			found = true
+		}
+	}
+
+	return best, found
+}
+
+func averageRating(checkins []*untappd.Checkin) float64 {
+	total := 0.0
+	for _, c := range checkins {
+		total += c.UserRating
+	}
+	return total / float64(len(checkins))
+}
+
+// ratedCheckins returns the checkins which have a rating.
+func ratedCheckins(checkins []*untappd.Checkin) []*untappd.Checkin {
+	rated := make([]*untappd.Checkin, 0, len(checkins))
+	for _, c := range checkins {
+		if c.UserRating > 0 {
+			rated = append(rated, c)
+		}
+	}
+	return rated
+}
+
+// breweryCount is how many times a user has checked in beers from a
+// brewery, and their average rating of it.
+type breweryCount struct {
+	brewery *untappd.Brewery
+	count   int
+	rating  float64
+}
+
+// favoriteBrewery returns the brewery with the most checkins. Ties are
+// broken by the average rating, then by name.
+func favoriteBrewery(checkins []*untappd.Checkin) (breweryCount, bool) {
+	byBrewery := make(map[int][]*untappd.Checkin)
+	for _, c := range checkins {
+		byBrewery[c.Brewery.ID] = append(byBrewery[c.Brewery.ID], c)
+	}
+
+	var best breweryCount
+	found := false
+	for _, cs := range byBrewery {
+		candidate := breweryCount{cs[0].Brewery, len(cs), 0}
+		if rated := ratedCheckins(cs); len(rated) > 0 {
+			candidate.rating = averageRating(rated)
+		}
+
+		if !found || candidate.count > best.count ||
+			(candidate.count == best.count && candidate.rating > best.rating) ||
+			(candidate.count == best.count && candidate.rating == best.rating &&
+				candidate.brewery.Name < best.brewery.Name) {
+			best = candidate
+			found = true
+		}
+	}
+
+	return best, found
+}
+
+// beerPopularity is the number of distinct users who checked in a beer.
+type beerPopularity struct {
+	checkin *untappd.Checkin
+	users   int
+}
+
+// trendingBeers returns the n beers checked in by the most distinct users
+// since the given time.
+func trendingBeers(userCheckins map[string][]*untappd.Checkin, since time.Time, n int) []beerPopularity {
+	byBeer := make(map[int]*beerPopularity)
+	for _, checkins := range userCheckins {
+		seen := make(map[int]bool)
+		for _, c := range checkins {
+			if c.Created.Before(since) || seen[c.Beer.ID] {
+				continue
+			}
+			seen[c.Beer.ID] = true
+			if p, ok := byBeer[c.Beer.ID]; ok {
+				p.users++
+			} else {
+				byBeer[c.Beer.ID] = &beerPopularity{c, 1}
+			}
+		}
+	}
+
+	trending := make([]beerPopularity, 0, len(byBeer))
+	for _, p := range byBeer {
+		trending = append(trending, *p)
+	}
+	sort.Slice(trending, func(i, j int) bool {
+		if trending[i].users != trending[j].users {
+			return trending[i].users > trending[j].users
+		}
+		return trending[i].checkin.Beer.Name < trending[j].checkin.Beer.Name
+	})
+
+	return trending[:min(n, len(trending))]
+}
+
+// findCachedBeer finds the cached beer best matching the query: a beer
+// with exactly that name, or else the most checked in beer whose name
+// contains the query. The returned checkin is one of the beer's checkins.
+func findCachedBeer(userCheckins map[string][]*untappd.Checkin, query string) (*untappd.Checkin, bool) {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" {
+		return nil, false
+	}
+
+	var best []*untappd.Checkin
+	for _, checkins := range checkinsByBeer(userCheckins) {
+		name := strings.ToLower(checkins[0].Beer.Name)
+		if name == query {
+			return checkins[0], true
+		}
+		if strings.Contains(name, query) && len(checkins) > len(best) {
+			best = checkins
+		}
+	}
+
+	if best == nil {
+		return nil, false
+	}
+	return best[0], true
+}
+
+// Minimum number of users who must have rated a beer for !outlier.
+const outlierMinRaters int = 3
+
+// ratingOutlier finds the user whose average rating of the beer is
+// furthest from the group's average. Only rated checkins count, and users
+// who never rated the beer are left out.
+func ratingOutlier(userCheckins map[string][]*untappd.Checkin, beer *untappd.Beer) (string, float64, float64, bool) {
+	averages := make(map[string]float64)
+	var total float64
+	var count int
+	for user, checkins := range userCheckins {
+		var sum float64
+		rated := 0
+		for _, c := range checkins {
+			if c.Beer.ID == beer.ID && c.UserRating > 0 {
+				sum += c.UserRating
+				rated++
+			}
+		}
+		if rated > 0 {
+			averages[user] = sum / float64(rated)
+			total += sum
+			count += rated
+		}
+	}
+	if len(averages) < outlierMinRaters {
+		return "", 0, 0, false
+	}
+
+	groupAvg := total / float64(count)
+	outlier := ""
+	for user, avg := range averages {
+		if outlier == "" || math.Abs(avg-groupAvg) > math.Abs(averages[outlier]-groupAvg) ||
+			(math.Abs(avg-groupAvg) == math.Abs(averages[outlier]-groupAvg) && user < outlier) {
+			outlier = user
+		}
+	}
+
+	return outlier, averages[outlier], groupAvg, true
+}
+
+// groupCounts returns the number of checkins, distinct beers and distinct
+// breweries of all users together.
+func groupCounts(userCheckins map[string][]*untappd.Checkin) (int, int, int) {
+	checkins := 0
+	beers := make(map[int]bool)
+	breweries := make(map[int]bool)
+	for _, cs := range userCheckins {
+		checkins += len(cs)
+		for _, c := range cs {
+			beers[c.Beer.ID] = true
+			breweries[c.Brewery.ID] = true
+		}
+	}
+	return checkins, len(beers), len(breweries)
+}
+
+// beerRating is the group's average rating of a beer.
+type beerRating struct {
+	checkin *untappd.Checkin
+	avg     float64
+	raters  int
+}
+
+// lovedBeers returns the beers rated at least minAvg on average by at least
+// minRaters different users, best rated first.
+func lovedBeers(userCheckins map[string][]*untappd.Checkin, minAvg float64, minRaters int) []beerRating {
+	loved := make([]beerRating, 0)
+	for _, checkins := range checkinsByBeer(userCheckins) {
+		rated := ratedCheckins(checkins)
+		raters := make(map[string]bool)
+		for _, c := range rated {
+			raters[c.User.UserName] = true
+		}
+		if len(raters) < minRaters {
+			continue
+		}
+		if avg := averageRating(rated); avg >= minAvg {
+			loved = append(loved, beerRating{rated[len(rated)-1], avg, len(raters)})
+		}
+	}
+
+	sort.Slice(loved, func(i, j int) bool {
+		if loved[i].avg != loved[j].avg {
+			return loved[i].avg > loved[j].avg
+		}
+		return loved[i].checkin.Beer.Name < loved[j].checkin.Beer.Name
+	})
+	return loved
+}
+
+// hasHad returns true if any of the checkins is of the beer.
+func hasHad(checkins []*untappd.Checkin, beerID int) bool {
+	for _, c := range checkins {
+		if c.Beer.ID == beerID {
+			return true
+		}
+	}
+	return false
+}
+
+// A group session is at least groupSessionMinUsers different users
+// checking in at the same venue within groupSessionWindow.
+const groupSessionMinUsers int = 3
+const groupSessionWindow time.Duration = time.Hour
+
+// groupSessions finds the group sessions the new checkins are part of,
+// returning the checkins of each session, oldest first, by venue ID. The
+// others in a session may have checked in during earlier polls, so their
+// checkins are looked up in all the cached checkins. Every checkin of a
+// session is within groupSessionWindow of every other.
+func groupSessions(newCheckins []*untappd.Checkin, userCheckins map[string][]*untappd.Checkin) map[int][]*untappd.Checkin {
+	byVenue := make(map[int][]*untappd.Checkin)
+	for _, checkins := range userCheckins {
+		for _, c := range checkins {
+			if c.Venue != nil {
+				byVenue[c.Venue.ID] = append(byVenue[c.Venue.ID], c)
+			}
+		}
+	}
+	for _, cs := range byVenue {
+		sort.Sort(byCheckinTime(cs))
+	}
+
+	sessions := make(map[int][]*untappd.Checkin)
+	for _, checkin := range newCheckins {
+		if checkin.Venue == nil {
+			continue
+		}
+		venue := checkin.Venue.ID
+		cs := byVenue[venue]
+		// Try every window of checkins which includes this one
+		for i := range cs {
+			if cs[i].Created.After(checkin.Created) {
+				break
+			}
+			if checkin.Created.Sub(cs[i].Created) > groupSessionWindow {
+				continue
+			}
+			end := i
+			for end < len(cs) && cs[end].Created.Sub(cs[i].Created) <= groupSessionWindow {
+				end++
+			}
+			session := cs[i:end]
+			if n := len(sessionUsers(session)); n >= groupSessionMinUsers &&
+				n > len(sessionUsers(sessions[venue])) {
+				sessions[venue] = session
+			}
+		}
+	}
+	return sessions
+}
+
+// sessionUsers returns the users of the checkins, in the order they first
+// checked in.
+func sessionUsers(checkins []*untappd.Checkin) []string {
+	users := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, c := range checkins {
+		if !seen[c.User.UserName] {
+			seen[c.User.UserName] = true
+			users = append(users, c.User.UserName)
+		}
+	}
+	return users
+}
+
+// sessionTracker remembers the group sessions announced by venue ID, so
+// that a session is only announced again when someone joins it.
+type sessionTracker map[int]announcedSession
+
+type announcedSession struct {
+	users int
+	at    time.Time
+}
+
+// allow returns true, and records the session, if no session at the venue
+// with as many users has been announced within groupSessionWindow.
+func (t sessionTracker) allow(venue int, users int, now time.Time) bool {
+	if last, ok := t[venue]; ok && now.Sub(last.at) < groupSessionWindow && users <= last.users {
+		return false
+	}
+	t[venue] = announcedSession{users, now}
+	return true
+}
+
+// overtaken returns the users whose checkin count user passes by going
+// from counts[user] to one more checkin. Users of whom only the latest
+// checkins are cached are left out, since their count is not their total.
+func overtaken(user string, counts map[string]int, capped map[string]bool) []string {
+	passed := make([]string, 0)
+	if capped[user] {
+		return passed
+	}
+	for other, count := range counts {
+		if other != user && !capped[other] && count == counts[user] {
+			passed = append(passed, other)
+		}
+	}
+	sort.Strings(passed)
+	return passed
+}
+
+// Minimum time between announcing overtakes between the same two users, so
+// that users with about the same count don't keep trading places in the
+// channel.
+const overtakeDebounce time.Duration = 24 * time.Hour
+
+// overtakeTracker remembers when overtakes were last announced.
+type overtakeTracker map[[2]string]time.Time
+
+// allow returns true, and records the time, if an overtake between the two
+// users has not been announced within overtakeDebounce.
+func (t overtakeTracker) allow(a string, b string, now time.Time) bool {
+	if a > b {
+		a, b = b, a
+	}
+	key := [2]string{a, b}
+	if last, ok := t[key]; ok && now.Sub(last) < overtakeDebounce {
+		return false
+	}
+	t[key] = now
+	return true
+}
+
+// milestoneTracker remembers the checkin count of each user between polls,
+// to tell when they reach a milestone.
+type milestoneTracker struct {
+	milestones []int
+	counts     map[string]int
+}
+
+func newMilestoneTracker(milestones []int) *milestoneTracker {
+	return &milestoneTracker{milestones: milestones, counts: make(map[string]int)}
+}
+
+// update records the checkin count of a user and returns the highest
+// milestone passed since the last update. The first update of a user only
+// records the count.
+func (t *milestoneTracker) update(user string, count int) (int, bool) {
+	previous, ok := t.counts[user]
+	t.counts[user] = count
+	if !ok {
+		return 0, false
+	}
+
+	reached := 0
+	for _, m := range t.milestones {
+		if previous < m && count >= m && m > reached {
+			reached = m
+		}
+	}
+	return reached, reached > 0
+}
+
+// styleRating is a user's average rating of a beer style.
+type styleRating struct {
+	style string
+	avg   float64
+	last  time.Time
+}
+
+// styleRatings returns the average rating of each style with at least
+// minRated rated checkins, best rated first.
+func styleRatings(checkins []*untappd.Checkin, minRated int) []styleRating {
+	byStyle := make(map[string][]*untappd.Checkin)
+	for _, c := range ratedCheckins(checkins) {
+		byStyle[c.Beer.Style] = append(byStyle[c.Beer.Style], c)
+	}
+
+	ratings := make([]styleRating, 0, len(byStyle))
+	for style, cs := range byStyle {
+		if len(cs) < minRated {
+			continue
+		}
+		sort.Sort(byCheckinTime(cs))
+		ratings = append(ratings, styleRating{style, averageRating(cs), cs[len(cs)-1].Created})
+	}
+	sort.Slice(ratings, func(i, j int) bool {
+		if ratings[i].avg != ratings[j].avg {
+			return ratings[i].avg > ratings[j].avg
+		}
+		return ratings[i].style < ratings[j].style
+	})
+	return ratings
+}
+
+// ordinal formats n as 1st, 2nd, 3rd, 4th...
+func ordinal(n int) string {
+	suffix := "th"
+	switch {
+	case n%100 >= 11 && n%100 <= 13:
+	case n%10 == 1:
+		suffix = "st"
+	case n%10 == 2:
+		suffix = "nd"
+	case n%10 == 3:
+		suffix = "rd"
+	}
+	return strconv.Itoa(n) + suffix
+}
+
+// standing returns the rank of user among all users by average rating
+// and by number of checkins. Rank 1 is the highest.
+func standing(userCheckins map[string][]*untappd.Checkin, user string) (int, int) {
+	count, mean, _ := getUserStats(userCheckins[user])
+	byRating, byCount := 1, 1
+	for other, checkins := range userCheckins {
+		if other == user {
+			continue
+		}
+		c, m, _ := getUserStats(checkins)
+		if m > mean {
+			byRating++
+		}
+		if c > count {
+			byCount++
+		}
+	}
+	return byRating, byCount
+}
+
+// longestComment returns the checkin with the longest comment, counted in
+// runes.
+func longestComment(checkins []*untappd.Checkin) (*untappd.Checkin, bool) {
+	var longest *untappd.Checkin
+	length := 0
+	for _, c := range checkins {
+		if n := utf8.RuneCountInString(c.Comment); n > length {
+			longest, length = c, n
+		}
+	}
+	return longest, longest != nil
+}
+
+// truncate shortens s to at most n runes, ending it with an ellipsis if it
+// was cut.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:n-1]) + "…"
+}
+
+// leaderboardEntry is the average rating and number of checkins of a user.
+type leaderboardEntry struct {
+	user    string
+	average float64
+	count   int
+}
+
+// buildLeaderboard ranks the users with checkins by average rating,
+// highest first. Ties are broken by number of checkins, then by name.
+func buildLeaderboard(userCheckins map[string][]*untappd.Checkin) []leaderboardEntry {
+	entries := make([]leaderboardEntry, 0, len(userCheckins))
+	for user, checkins := range userCheckins {
+		if len(checkins) == 0 {
+			continue
+		}
+		count, average, _ := getUserStats(checkins)
+		entries = append(entries, leaderboardEntry{user, average, count})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].average != entries[j].average {
+			return entries[i].average > entries[j].average
+		}
+		if entries[i].count != entries[j].count {
+			return entries[i].count > entries[j].count
+		}
+		return entries[i].user < entries[j].user
+	})
+	return entries
+}
+
+// recentCheckins returns the n most recent checkins, newest first. There
+// may be fewer if there aren't n of them.
+func recentCheckins(checkins []*untappd.Checkin, n int) []*untappd.Checkin {
+	recent := append([]*untappd.Checkin(nil), checkins...)
+	sort.Sort(sort.Reverse(byCheckinTime(recent)))
+	return recent[:min(n, len(recent))]
+}
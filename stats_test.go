@@ -0,0 +1,255 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/untappd"
+)
+
+func TestRatingOutlier(t *testing.T) {
+	at := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	beer := &untappd.Beer{ID: 1}
+	userCheckins := map[string][]*untappd.Checkin{
+		// Unrated checkins don't pull alice's average down
+		"alice": {testCheckin(1, "alice", 1, 4, at), testCheckin(2, "alice", 1, 0, at), testCheckin(3, "alice", 1, 4, at)},
+		"bob":   {testCheckin(4, "bob", 1, 4, at)},
+		"carol": {testCheckin(5, "carol", 1, 2, at)},
+		// Never rated it, so not one of the raters
+		"dave": {testCheckin(6, "dave", 1, 0, at), testCheckin(7, "dave", 2, 5, at)},
+	}
+
+	user, rating, groupAvg, ok := ratingOutlier(userCheckins, beer)
+	if !ok || user != "carol" || rating != 2 {
+		t.Fatalf("got %s at %0.2f, %v, want carol at 2.00", user, rating, ok)
+	}
+	// The four rated checkins: (4 + 4 + 4 + 2) / 4
+	if math.Abs(groupAvg-3.5) > 1e-9 {
+		t.Errorf("got a group average of %0.2f, want 3.50", groupAvg)
+	}
+
+	// Dave's unrated checkin doesn't make up for a third rater
+	delete(userCheckins, "bob")
+	if user, _, _, ok := ratingOutlier(userCheckins, beer); ok {
+		t.Errorf("got %s, want too few raters", user)
+	}
+}
+
+// atVenue returns the checkin made at the venue.
+func atVenue(c *untappd.Checkin, venue *untappd.Venue) *untappd.Checkin {
+	c.Venue = venue
+	return c
+}
+
+func TestGroupSessions(t *testing.T) {
+	bar := &untappd.Venue{ID: 1, Name: "The Local"}
+	pub := &untappd.Venue{ID: 2, Name: "The Pub"}
+	t0 := time.Date(2020, 1, 1, 18, 0, 0, 0, time.UTC)
+
+	alice := atVenue(testCheckin(1, "alice", 1, 4, t0), bar)
+	bob := atVenue(testCheckin(2, "bob", 1, 4, t0.Add(20*time.Minute)), bar)
+	carol := atVenue(testCheckin(3, "carol", 1, 4, t0.Add(40*time.Minute)), bar)
+	userCheckins := map[string][]*untappd.Checkin{
+		"alice": {alice},
+		"bob":   {bob},
+		"carol": {carol, atVenue(testCheckin(4, "carol", 2, 4, t0.Add(45*time.Minute)), pub)},
+	}
+
+	// Alice and bob checked in during earlier polls
+	sessions := groupSessions([]*untappd.Checkin{carol}, userCheckins)
+	if got := sessionUsers(sessions[bar.ID]); len(got) != 3 || got[0] != "alice" || got[2] != "carol" {
+		t.Errorf("got %v, want alice, bob and carol", got)
+	}
+	if len(sessions) != 1 {
+		t.Errorf("got sessions at %d venues, want 1", len(sessions))
+	}
+
+	// Each checkin is within an hour of the one before, but not of the first
+	carol.Created = t0.Add(90 * time.Minute)
+	if sessions := groupSessions([]*untappd.Checkin{carol}, userCheckins); len(sessions) != 0 {
+		t.Errorf("got %v, want no session spanning more than the window", sessions)
+	}
+
+	// A later checkin at the same venue isn't part of the earlier session
+	carol.Created = t0.Add(40 * time.Minute)
+	dave := atVenue(testCheckin(5, "dave", 1, 4, t0.Add(3*time.Hour)), bar)
+	userCheckins["dave"] = []*untappd.Checkin{dave}
+	if sessions := groupSessions([]*untappd.Checkin{dave}, userCheckins); len(sessions) != 0 {
+		t.Errorf("got %v, want no session for a checkin long after it", sessions)
+	}
+}
+
+func TestSessionTracker(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 18, 0, 0, 0, time.UTC)
+	sessions := make(sessionTracker)
+	if !sessions.allow(1, 3, t0) {
+		t.Error("want a new session announced")
+	}
+	if sessions.allow(1, 3, t0.Add(10*time.Minute)) {
+		t.Error("want the same session not announced again")
+	}
+	if !sessions.allow(1, 4, t0.Add(20*time.Minute)) {
+		t.Error("want the session announced again when someone joins")
+	}
+	if !sessions.allow(1, 3, t0.Add(3*time.Hour)) {
+		t.Error("want a later session announced")
+	}
+}
+
+func TestOvertaken(t *testing.T) {
+	counts := map[string]int{"alice": 10, "bob": 10, "carol": 10, "dave": 11, "erin": 300}
+	if got := overtaken("alice", counts, nil); len(got) != 2 || got[0] != "bob" || got[1] != "carol" {
+		t.Errorf("got %v, want bob and carol passed", got)
+	}
+
+	// Capped users all stop at the same count, which isn't their total
+	counts = map[string]int{"alice": 300, "bob": 300, "carol": 300}
+	capped := map[string]bool{"bob": true, "carol": true}
+	if got := overtaken("alice", counts, capped); len(got) != 0 {
+		t.Errorf("got %v, want capped users never passed", got)
+	}
+	if got := overtaken("bob", counts, capped); len(got) != 0 {
+		t.Errorf("got %v, want capped users never passing", got)
+	}
+}
+
+func TestOvertakeTracker(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 18, 0, 0, 0, time.UTC)
+	overtakes := make(overtakeTracker)
+	if !overtakes.allow("alice", "bob", t0) {
+		t.Error("want the first overtake announced")
+	}
+	if overtakes.allow("bob", "alice", t0.Add(time.Hour)) {
+		t.Error("want trading places again soon after not announced")
+	}
+	if !overtakes.allow("bob", "alice", t0.Add(overtakeDebounce)) {
+		t.Error("want an overtake announced after the debounce")
+	}
+}
+
+// rated returns checkins by user with the ratings, one of each beer.
+func rated(user string, first int, ratings ...float64) []*untappd.Checkin {
+	checkins := testCheckins(user, first, len(ratings))
+	for i, r := range ratings {
+		checkins[i].UserRating = r
+	}
+	return checkins
+}
+
+func TestBuildLeaderboard(t *testing.T) {
+	userCheckins := map[string][]*untappd.Checkin{
+		"alice": rated("alice", 1, 4, 4),
+		"bob":   rated("bob", 10, 3, 5, 4),
+		"carol": rated("carol", 20, 4.5),
+		"dave":  rated("dave", 30, 4, 4),
+		"erin":  rated("erin", 40, 2),
+		"frank": nil,
+	}
+
+	entries := buildLeaderboard(userCheckins)
+	users := make([]string, 0, len(entries))
+	for _, e := range entries {
+		users = append(users, e.user)
+	}
+	// Bob, alice and dave tie at 4.0: most checkins first, then by name
+	if got := strings.Join(users, ","); got != "carol,bob,alice,dave,erin" {
+		t.Errorf("got %s, want carol,bob,alice,dave,erin", got)
+	}
+	if entries[1].average != 4 || entries[1].count != 3 {
+		t.Errorf("got %+v for bob, want 4.0 from 3 checkins", entries[1])
+	}
+}
+
+func TestMilestoneTracker(t *testing.T) {
+	m := newMilestoneTracker([]int{100, 250, 500})
+
+	if _, ok := m.update("alice", 120); ok {
+		t.Error("got a milestone on the first count, want it only recorded")
+	}
+	if _, ok := m.update("alice", 240); ok {
+		t.Error("got a milestone between 100 and 250")
+	}
+	if got, ok := m.update("alice", 250); !ok || got != 250 {
+		t.Errorf("got %d, %v at 250, want 250", got, ok)
+	}
+	if _, ok := m.update("alice", 260); ok {
+		t.Error("got 250 again, want each milestone once")
+	}
+	// Passing several at once only announces the highest
+	if got, ok := m.update("alice", 600); !ok || got != 500 {
+		t.Errorf("got %d, %v from 260 to 600, want 500", got, ok)
+	}
+	if _, ok := m.update("bob", 99); ok {
+		t.Error("got a milestone for bob's first count")
+	}
+	if got, ok := m.update("bob", 100); !ok || got != 100 {
+		t.Errorf("got %d, %v for bob at 100, want 100", got, ok)
+	}
+}
+
+func TestStyleHistogram(t *testing.T) {
+	checkins := testCheckins("alice", 1, 7)
+	for i, style := range []string{"IPA", "Stout", "IPA", "Sour", "Stout", "IPA", "Lager"} {
+		checkins[i].Beer.Style = style
+	}
+
+	histogram := styleHistogram(checkins)
+	if len(histogram) != 4 || histogram["IPA"] != 3 || histogram["Stout"] != 2 || histogram["Lager"] != 1 {
+		t.Errorf("got %v, want 3 IPA, 2 Stout, 1 Sour and 1 Lager", histogram)
+	}
+
+	// Lager and Sour tie, and are ordered by name
+	top := topStyles(histogram, 3)
+	want := []styleCount{{"IPA", 3}, {"Stout", 2}, {"Lager", 1}}
+	if len(top) != len(want) {
+		t.Fatalf("got %v, want %v", top, want)
+	}
+	for i := range want {
+		if top[i] != want[i] {
+			t.Errorf("got %v, want %v", top, want)
+			break
+		}
+	}
+	if top := topStyles(histogram, 10); len(top) != 4 {
+		t.Errorf("got %d styles, want all 4", len(top))
+	}
+
+	if s := formatStyles(top, len(checkins), true); s != "IPA 3 (43%), Stout 2 (29%), Lager 1 (14%)" {
+		t.Errorf("got %q", s)
+	}
+}
+
+func TestFindCachedBeer(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	named := func(id int, user string, beerID int, name string) *untappd.Checkin {
+		c := testCheckin(id, user, beerID, 4, start.Add(time.Duration(id)*time.Hour))
+		c.Beer.Name = name
+		return c
+	}
+	userCheckins := map[string][]*untappd.Checkin{
+		"alice": {named(1, "alice", 1, "Pliny the Elder"), named(2, "alice", 2, "Pliny the Younger")},
+		"bob":   {named(3, "bob", 2, "Pliny the Younger"), named(4, "bob", 3, "Elder")},
+	}
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"pliny the elder", 1}, // exact match
+		{"PLINY", 2},           // the most checked in of two
+		{"elder", 3},           // exact beats a longer name containing it
+		{"  younger ", 2},
+	}
+	for _, tt := range tests {
+		if c, ok := findCachedBeer(userCheckins, tt.query); !ok || c.Beer.ID != tt.want {
+			t.Errorf("%q: got %v, want beer %d", tt.query, c, tt.want)
+		}
+	}
+	for _, query := range []string{"", "heady topper"} {
+		if c, ok := findCachedBeer(userCheckins, query); ok {
+			t.Errorf("%q: got beer %d, want no match", query, c.Beer.ID)
+		}
+	}
+}
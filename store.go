@@ -0,0 +1,134 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/mdlayher/untappd"
+)
+
+// checkinStore holds the cached checkins of every tracked user, sorted
+// oldest first. It is shared between the untappd loop and the irc
+// command handlers. The IDs of each user's checkins are also kept in a
+// set, for quickly telling whether a checkin is new.
+type checkinStore struct {
+	mu       sync.RWMutex
+	checkins map[string][]*untappd.Checkin
+	seen     map[string]map[int]struct{}
+}
+
+func newCheckinStore() *checkinStore {
+	return &checkinStore{
+		checkins: make(map[string][]*untappd.Checkin),
+		seen:     make(map[string]map[int]struct{}),
+	}
+}
+
+// checkinIDs returns the set of IDs of the checkins.
+func checkinIDs(checkins []*untappd.Checkin) map[int]struct{} {
+	ids := make(map[int]struct{}, len(checkins))
+	for _, c := range checkins {
+		ids[c.ID] = struct{}{}
+	}
+	return ids
+}
+
+// Get returns a copy of the checkins cached for a user.
+func (s *checkinStore) Get(user string) ([]*untappd.Checkin, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	checkins, ok := s.checkins[user]
+	return append([]*untappd.Checkin(nil), checkins...), ok
+}
+
+// Has returns true if the checkin is cached for the user.
+func (s *checkinStore) Has(user string, id int) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.seen[user][id]
+	return ok
+}
+
+// HasUser returns true if there is a cache for the user, even if empty.
+func (s *checkinStore) HasUser(user string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.checkins[user]
+	return ok
+}
+
+// Set replaces the checkins cached for a user.
+func (s *checkinStore) Set(user string, checkins []*untappd.Checkin) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	checkins = append([]*untappd.Checkin(nil), checkins...)
+	sort.Sort(byCheckinTime(checkins))
+	s.checkins[user] = checkins
+	s.seen[user] = checkinIDs(checkins)
+}
+
+// Append adds a checkin to the cache of a user.
+func (s *checkinStore) Append(user string, checkin *untappd.Checkin) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	checkins := append(s.checkins[user], checkin)
+	sort.Sort(byCheckinTime(checkins))
+	s.checkins[user] = checkins
+	if s.seen[user] == nil {
+		s.seen[user] = make(map[int]struct{})
+	}
+	s.seen[user][checkin.ID] = struct{}{}
+}
+
+// Remove deletes a checkin from the cache of a user.
+func (s *checkinStore) Remove(user string, id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	checkins := make([]*untappd.Checkin, 0, len(s.checkins[user]))
+	for _, c := range s.checkins[user] {
+		if c.ID != id {
+			checkins = append(checkins, c)
+		}
+	}
+	s.checkins[user] = checkins
+	delete(s.seen[user], id)
+}
+
+// Delete removes the cache of a user.
+func (s *checkinStore) Delete(user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.checkins, user)
+	delete(s.seen, user)
+}
+
+// Snapshot returns a copy of the whole cache.
+func (s *checkinStore) Snapshot() map[string][]*untappd.Checkin {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snapshot := make(map[string][]*untappd.Checkin, len(s.checkins))
+	for user, checkins := range s.checkins {
+		snapshot[user] = append([]*untappd.Checkin(nil), checkins...)
+	}
+	return snapshot
+}
+
+// Counts returns the number of cached checkins of each user.
+func (s *checkinStore) Counts() map[string]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := make(map[string]int, len(s.checkins))
+	for user, checkins := range s.checkins {
+		counts[user] = len(checkins)
+	}
+	return counts
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/mdlayher/untappd"
+)
+
+func TestCheckinStore(t *testing.T) {
+	store := newCheckinStore()
+	checkins := testCheckins("alice", 1, 3)
+	store.Set("alice", []*untappd.Checkin{checkins[2], checkins[0]})
+
+	if !store.Has("alice", 1) || store.Has("alice", 2) || store.Has("bob", 1) {
+		t.Error("want only the set checkins seen")
+	}
+	store.Append("alice", checkins[1])
+	got, ok := store.Get("alice")
+	if !ok || len(got) != 3 || got[0].ID != 1 || got[1].ID != 2 || got[2].ID != 3 {
+		t.Fatalf("got %v, want all three oldest first", ids(got))
+	}
+
+	store.Remove("alice", 2)
+	if store.Has("alice", 2) || store.Counts()["alice"] != 2 {
+		t.Error("want checkin 2 removed from the slice and the set")
+	}
+
+	store.Delete("alice")
+	if store.HasUser("alice") || len(store.Snapshot()) != 0 {
+		t.Error("want alice gone")
+	}
+}
+
+// Run with -race: the poll loop writes to the store while commands and
+// the http handlers read from it.
+func TestCheckinStoreConcurrentAccess(t *testing.T) {
+	store := newCheckinStore()
+	checkins := testCheckins("alice", 1, 200)
+	store.Set("alice", checkins[:1])
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for _, c := range checkins[1:] {
+			store.Append("alice", c)
+			if c.ID%10 == 0 {
+				store.Remove("alice", c.ID-1)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			for _, c := range store.Snapshot()["alice"] {
+				_ = c.ID
+			}
+			store.Counts()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 200; i++ {
+			store.Has("alice", i)
+			if got, ok := store.Get("alice"); ok {
+				_ = len(got)
+			}
+		}
+	}()
+	wg.Wait()
+
+	if n := store.Counts()["alice"]; n != 180 {
+		t.Errorf("got %d checkins, want 180", n)
+	}
+}
+
+// The cache holds about CheckinApiLimit checkins per user.
+func benchmarkCheckins() []*untappd.Checkin {
+	return testCheckins("alice", 1, CheckinApiLimit)
+}
+
+// isCheckinNewLinear is how new checkins were found before the store kept
+// a set of IDs.
+func isCheckinNewLinear(checkin *untappd.Checkin, checkins []*untappd.Checkin) bool {
+	for _, c := range checkins {
+		if c.ID == checkin.ID {
+			return false
+		}
+	}
+	return true
+}
+
+func BenchmarkIsCheckinNewLinear(b *testing.B) {
+	checkins := benchmarkCheckins()
+	fetched := testCheckins("alice", CheckinApiLimit-10, 25)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, c := range fetched {
+			isCheckinNewLinear(c, checkins)
+		}
+	}
+}
+
+func BenchmarkIsCheckinNewSet(b *testing.B) {
+	store := newCheckinStore()
+	store.Set("alice", benchmarkCheckins())
+	fetched := testCheckins("alice", CheckinApiLimit-10, 25)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, c := range fetched {
+			store.Has("alice", c.ID)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/mdlayher/untappd"
+)
+
+// checkinTemplates are the text/template strings used instead of the
+// built-in format of the lines of an announced checkin. The checkin is
+// the data of each template. Empty ones keep the built-in format.
+type checkinTemplates struct {
+	General string `json:"general"`
+	Style   string `json:"style"`
+	Rating  string `json:"rating"`
+	Venue   string `json:"venue"`
+
+	general *template.Template
+	style   *template.Template
+	rating  *template.Template
+	venue   *template.Template
+}
+
+// compile parses the templates, so that mistakes are found at startup.
+func (t *checkinTemplates) compile() error {
+	parts := []struct {
+		name   string
+		text   string
+		parsed **template.Template
+	}{
+		{"general", t.General, &t.general},
+		{"style", t.Style, &t.style},
+		{"rating", t.Rating, &t.rating},
+		{"venue", t.Venue, &t.venue},
+	}
+	for _, part := range parts {
+		if part.text == "" {
+			continue
+		}
+		parsed, err := template.New(part.name).Option("missingkey=error").Parse(part.text)
+		if err != nil {
+			return fmt.Errorf("templates.%s: %s", part.name, err)
+		}
+		*part.parsed = parsed
+	}
+	return nil
+}
+
+// execute formats the checkin with tmpl, or returns fallback if there is
+// no template or it fails.
+func execute(tmpl *template.Template, checkin *untappd.Checkin, fallback string) string {
+	if tmpl == nil {
+		return fallback
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, checkin); err != nil {
+		warnw("Unable to format checkin", "template", tmpl.Name(), "checkin_id", checkin.ID, "error", err)
+		return fallback
+	}
+	return b.String()
+}
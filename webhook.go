@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jpillora/backoff"
+	"github.com/mdlayher/untappd"
+)
+
+// Number of attempts at delivering a checkin to the webhook.
+const webhookAttempts int = 5
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhookPayload is the json posted to the webhook for each checkin.
+type webhookPayload struct {
+	ID      int       `json:"checkin_id"`
+	User    string    `json:"user"`
+	Beer    string    `json:"beer"`
+	BeerID  int       `json:"beer_id"`
+	Brewery string    `json:"brewery"`
+	Style   string    `json:"style"`
+	ABV     float64   `json:"abv"`
+	Rating  float64   `json:"rating"`
+	Comment string    `json:"comment"`
+	Venue   string    `json:"venue,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+func newWebhookPayload(checkin *untappd.Checkin) webhookPayload {
+	p := webhookPayload{
+		ID:      checkin.ID,
+		User:    checkin.User.UserName,
+		Beer:    checkin.Beer.Name,
+		BeerID:  checkin.Beer.ID,
+		Brewery: checkin.Brewery.Name,
+		Style:   checkin.Beer.Style,
+		ABV:     checkin.Beer.ABV,
+		Rating:  checkin.UserRating,
+		Comment: checkin.Comment,
+		Created: checkin.Created,
+	}
+	if checkin.Venue != nil {
+		p.Venue = checkin.Venue.Name
+	}
+	return p
+}
+
+// signPayload returns the hex encoded HMAC-SHA256 of body.
+func signPayload(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// postWebhook posts a single checkin to the webhook. The body is signed
+// with config.WebhookSecret in the X-Signature-256 header.
+func postWebhook(body []byte) error {
+	req, err := http.NewRequest("POST", config.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Signature-256", "sha256="+signPayload(body, config.WebhookSecret))
+
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", res.Status)
+	}
+	return nil
+}
+
+// queueWebhook hands the checkin to webhookLoop without waiting, so that a
+// slow webhook never holds up the announcements. The checkin is dropped if
+// the queue is full.
+func queueWebhook(webhooks chan *untappd.Checkin, checkin *untappd.Checkin) {
+	select {
+	case webhooks <- checkin:
+	default:
+		warnw("Webhook queue full, dropping checkin", "checkin_id", checkin.ID)
+	}
+}
+
+// webhookLoop posts the checkins to the webhook as they arrive, retrying
+// failed deliveries with backoff.
+func webhookLoop(checkins chan *untappd.Checkin) {
+	for checkin := range checkins {
+		body, err := json.Marshal(newWebhookPayload(checkin))
+		if err != nil {
+			warnw("Unable to encode checkin for webhook", "checkin_id", checkin.ID, "error", err)
+			continue
+		}
+
+		b := &backoff.Backoff{
+			Min:    time.Second,
+			Max:    time.Minute,
+			Factor: 2,
+			Jitter: true,
+		}
+		for attempt := 1; ; attempt++ {
+			err := postWebhook(body)
+			if err == nil {
+				break
+			}
+			if attempt == webhookAttempts {
+				warnw("Giving up on webhook", "checkin_id", checkin.ID, "error", err)
+				break
+			}
+			d := b.Duration()
+			warnw("Webhook failed, retrying", "checkin_id", checkin.ID, "error", err, "wait", d)
+			time.Sleep(d)
+		}
+	}
+}
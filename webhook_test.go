@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/untappd"
+)
+
+func TestQueueWebhookDoesNotBlock(t *testing.T) {
+	webhooks := make(chan *untappd.Checkin, 1)
+	at := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	done := make(chan struct{})
+	go func() {
+		queueWebhook(webhooks, testCheckin(1, "alice", 1, 4, at))
+		queueWebhook(webhooks, testCheckin(2, "alice", 1, 4, at))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("blocked on a full webhook queue")
+	}
+	if c := <-webhooks; c.ID != 1 {
+		t.Errorf("got checkin %d queued, want the first one", c.ID)
+	}
+}
+
+func TestPostWebhookSigned(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	var signature string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get("X-Signature-256")
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+	config = Config{WebhookURL: server.URL, WebhookSecret: "secret"}
+
+	if err := postWebhook([]byte(`{"checkin_id":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if want := "sha256=" + signPayload(body, "secret"); signature != want {
+		t.Errorf("got signature %q, want %q", signature, want)
+	}
+	if signPayload(body, "other") == signPayload(body, "secret") {
+		t.Error("want the signature to depend on the secret")
+	}
+}
+
+func TestUntappdLoopPostsBatchedCheckins(t *testing.T) {
+	defer func(c Config) { config = c }(config)
+	var mu sync.Mutex
+	posted := make([]int, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p webhookPayload
+		json.NewDecoder(r.Body).Decode(&p)
+		mu.Lock()
+		posted = append(posted, p.ID)
+		mu.Unlock()
+	}))
+	defer server.Close()
+	config = Config{
+		Users:              []User{{Name: "alice"}},
+		Location:           time.UTC,
+		InitialFetchCount:  CheckinApiLimit,
+		StartupStats:       "off",
+		UnreachableAfter:   5,
+		BatchThreshold:     3,
+		BatchAnnounceCount: 1,
+		WebhookURL:         server.URL,
+	}
+
+	source := newFakeSource(testCheckins("alice", 1, 5)...)
+	source.pending["alice"] = testCheckins("alice", 6, 5)
+	webhooks := make(chan *untappd.Checkin, 10)
+	go webhookLoop(webhooks)
+	defer close(webhooks)
+
+	announcedBefore := scrape(t, "untappd_checkins_announced_total")
+	messages := runPollCycle(t, source, newCheckinStore(), newApiBudget(ApiCallsPerHour), webhooks)
+	if len(messages) == 0 || messages[0] != "Catching up on 4 earlier checkins: alice 4." {
+		t.Errorf("got %q, want the older checkins summarized", messages)
+	}
+	if got := scrape(t, "untappd_checkins_announced_total"); got != announcedBefore+5 {
+		t.Errorf("got %v checkins announced, want %v", got, announcedBefore+5)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(posted)
+		mu.Unlock()
+		if n >= 5 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Ints(posted)
+	if fmt.Sprint(posted) != "[6 7 8 9 10]" {
+		t.Errorf("posted %v, want each new checkin once", posted)
+	}
+}